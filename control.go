@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/gitfs/fs"
+)
+
+// controlSocketDir returns the directory holding the default control
+// sockets of the user's mounts, creating it if create is set.
+func controlSocketDir(create bool) (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir != "" {
+		dir = filepath.Join(dir, "gitfs")
+	} else {
+		dir = filepath.Join(os.TempDir(), fmt.Sprintf("gitfs-%d", os.Getuid()))
+	}
+	if !create {
+		return dir, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// In a shared temp dir, someone else may have made it first.
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || !fi.IsDir() || int(st.Uid) != os.Getuid() || fi.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s is not a private directory of ours", dir)
+	}
+	return dir, nil
+}
+
+// defaultControlSocket returns the control socket a gitfs mounted at
+// the absolute path mnt serves on, unless given -control. It is named
+// after a hash of mnt, as socket paths are limited to 108 bytes.
+func defaultControlSocket(mnt string, create bool) (string, error) {
+	dir, err := controlSocketDir(create)
+	if err != nil {
+		return "", err
+	}
+	h := sha1.Sum([]byte(mnt))
+	return filepath.Join(dir, fmt.Sprintf("%x.sock", h[:8])), nil
+}
+
+// mountControlSocket returns the default control socket of the gitfs
+// mount containing name, and the path of name relative to it.
+func mountControlSocket(name string) (string, string, error) {
+	mnt, rel, err := findMount(name)
+	if err != nil {
+		return "", "", err
+	}
+	socket, err := defaultControlSocket(mnt.Dir, false)
+	return socket, rel, err
+}
+
+// controlCmd implements "gitfs control SOCKET METHOD [PATH [SOURCE]]",
+// printing the JSON response.
+func controlCmd(args []string) {
+	if len(args) < 2 || len(args) > 4 {
+		log.Fatalf("usage: %s control SOCKET METHOD [PATH [SOURCE]]", os.Args[0])
+	}
+	req := fs.ControlRequest{Method: args[1]}
+	if len(args) > 2 {
+		req.Path = args[2]
+	}
+	if len(args) > 3 {
+		req.Source = args[3]
+	}
+
+	resp, err := fs.CallControl(args[0], &req)
+	if resp == nil {
+		log.Fatalf("CallControl: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(resp)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// traceCmd implements "gitfs trace SOCKET start|stop|dump". Stop and
+// dump print the files accessed, one per line, with the repository,
+// path, object ID, operations and PIDs separated by tabs.
+func traceCmd(args []string) {
+	methods := map[string]string{
+		"start": "TraceStart",
+		"stop":  "TraceStop",
+		"dump":  "TraceDump",
+	}
+	if len(args) != 2 || methods[args[1]] == "" {
+		log.Fatalf("usage: %s trace SOCKET start|stop|dump", os.Args[0])
+	}
+
+	resp, err := fs.CallControl(args[0], &fs.ControlRequest{Method: methods[args[1]]})
+	if err != nil {
+		log.Fatalf("CallControl: %v", err)
+	}
+	// Not aligned, so that paths with spaces can be read back.
+	for _, e := range resp.Trace {
+		var pids []string
+		for _, p := range e.Pids {
+			pids = append(pids, fmt.Sprint(p))
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", e.Repo, e.Path, e.ID,
+			strings.Join(e.Ops, ","), strings.Join(pids, ","))
+	}
+}
+
+// warmCmd implements "gitfs warm [-j N] [-control SOCKET] MOUNT <
+// FILE". FILE lists paths relative to MOUNT, one per line, or is the
+// output of "gitfs trace SOCKET dump".
+func warmCmd(args []string) {
+	flags := flag.NewFlagSet("warm", flag.ExitOnError)
+	parallel := flags.Int("j", fs.DefaultWarmParallel, "blobs to load at once.")
+	control := flags.String("control", "", "the control socket of the mount, if it was mounted with -control.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("usage: %s warm [-j N] [-control SOCKET] MOUNT < FILE", os.Args[0])
+	}
+	socket, rel, err := mountControlSocket(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *control != "" {
+		socket = *control
+	}
+
+	req := fs.ControlRequest{Method: "Warm", Parallel: *parallel}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		l := scanner.Text()
+		if strings.TrimSpace(l) == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		// Trace lines have the repository, path and ID.
+		if f := strings.Split(l, "\t"); len(f) >= 3 && fs.SHA1RE.MatchString(f[2]) {
+			req.Targets = append(req.Targets, fs.WarmTarget{Repo: f[0], ID: f[2]})
+		} else if filepath.IsAbs(l) {
+			req.Targets = append(req.Targets, fs.WarmTarget{Path: l})
+		} else {
+			req.Targets = append(req.Targets, fs.WarmTarget{Path: filepath.Join(rel, l)})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("reading stdin: %v", err)
+	}
+
+	resp, err := fs.CallControl(socket, &req)
+	if err != nil {
+		log.Fatalf("CallControl: %v", err)
+	}
+	res := resp.Warm
+	for _, e := range res.Errors {
+		fmt.Fprintln(os.Stderr, e)
+	}
+	fmt.Printf("warmed %d blobs, %d bytes in %.2fs\n", res.Blobs, res.Bytes, res.Seconds)
+	if res.Skipped > 0 {
+		fmt.Printf("skipped %d blobs too large for the memory cache\n", res.Skipped)
+	}
+	if len(res.Errors) > 0 {
+		os.Exit(1)
+	}
+}
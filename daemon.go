@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// daemonChildEnv is set in the environment of the background process
+// started by daemonize.
+const daemonChildEnv = "GITFS_DAEMON_CHILD"
+
+// readyMessage is written to the readiness file descriptor once the
+// filesystem is mounted.
+const readyMessage = "ready\n"
+
+// daemonize starts "gitfs mount args" again in the background, and
+// exits once it has mounted the filesystem, with status 0, or has
+// failed, with status 1. In the background process, it returns the
+// file descriptor to report readiness on.
+func daemonize(args []string) int {
+	if fd := os.Getenv(daemonChildEnv); fd != "" {
+		os.Unsetenv(daemonChildEnv)
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			log.Fatalf("%s: %v", daemonChildEnv, err)
+		}
+		return n
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Executable: %v", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Fatalf("Pipe: %v", err)
+	}
+
+	cmd := exec.Command(exe, append([]string{"mount"}, args...)...)
+	// ExtraFiles start at fd 3.
+	cmd.Env = append(os.Environ(), daemonChildEnv+"=3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("starting daemon: %v", err)
+	}
+	w.Close()
+
+	// The read ends when the child reports readiness, or exits.
+	msg, _ := ioutil.ReadAll(r)
+	if string(msg) == readyMessage {
+		os.Exit(0)
+	}
+	if err := cmd.Wait(); err != nil {
+		log.Fatalf("daemon failed: %v", err)
+	}
+	log.Fatalf("daemon exited before mounting")
+	return 0
+}
+
+// notifyReady reports that the filesystem is mounted on readyFd, if
+// positive, and to systemd, if started with Type=notify.
+func notifyReady(readyFd int) {
+	if readyFd > 0 {
+		f := os.NewFile(uintptr(readyFd), "ready")
+		if _, err := f.Write([]byte(readyMessage)); err != nil {
+			log.Printf("gitfs: reporting readiness: %v", err)
+		}
+		f.Close()
+	}
+	if err := sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+		log.Printf("gitfs: sd_notify: %v", err)
+	}
+}
+
+// detachStderr points stderr of the background process, which it
+// shares with the command that started it, to logFile, or to
+// /dev/null if it is empty, so that it does not write to a terminal
+// or pipe after that command exits.
+func detachStderr(logFile string) {
+	name := os.DevNull
+	if logFile != "" {
+		name = logFile
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("gitfs: detaching stderr: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := syscall.Dup3(int(f.Fd()), syscall.Stderr, 0); err != nil {
+		log.Printf("gitfs: detaching stderr: %v", err)
+	}
+}
+
+// sdNotify sends a state change to the socket in $NOTIFY_SOCKET, as
+// sd_notify(3) does. It does nothing if the variable is not set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// Abstract socket.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// writePidfile writes the process ID to name.
+func writePidfile(name string) error {
+	return ioutil.WriteFile(name, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
@@ -0,0 +1,179 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Allowlist restricts what processes see in git trees. Set it in
+// GitFSOptions to restrict all trees mounted with those options.
+// Processes without a rule see everything.
+//
+// Since the kernel caches lookups for all processes alike, mounts
+// with an Allowlist must not cache directory entries; see
+// GitFSOptions.NodefsOptions.
+type Allowlist struct {
+	mu sync.Mutex
+	// keyed by AllowRule.Pid
+	rules map[uint32][]AllowRule
+}
+
+// AllowRule declares paths that a process, and all its descendants,
+// may see.
+type AllowRule struct {
+	// Pid is the process the rule applies to.
+	Pid uint32
+
+	// Repo restricts the rule to the trees of the repository in
+	// this directory, or with this work tree. If empty, it
+	// applies to all trees.
+	Repo string `json:",omitempty"`
+
+	// Paths are paths in the tree. A path makes everything below
+	// it visible, and its parent directories, so they can be
+	// traversed. Path components may be path.Match patterns.
+	Paths []string
+}
+
+// NewAllowlist returns an Allowlist without rules.
+func NewAllowlist() *Allowlist {
+	return &Allowlist{rules: map[uint32][]AllowRule{}}
+}
+
+// Add adds a rule. A process under several rules (eg. for
+// different repositories) may see the paths of each.
+func (a *Allowlist) Add(r AllowRule) {
+	if r.Repo != "" {
+		r.Repo = filepath.Clean(r.Repo)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules[r.Pid] = append(a.rules[r.Pid], r)
+}
+
+// Remove drops the rules for a process.
+func (a *Allowlist) Remove(pid uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.rules, pid)
+}
+
+// Rules lists the rules, ordered by PID.
+func (a *Allowlist) Rules() []AllowRule {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var rules []AllowRule
+	for _, rs := range a.rules {
+		rules = append(rules, rs...)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Pid < rules[j].Pid
+	})
+	return rules
+}
+
+// maxProcDepth bounds the walk up the process tree.
+const maxProcDepth = 256
+
+// allowed returns whether the process (or thread) pid may see path p
+// in a tree of the repository in repo. The rules of the closest
+// restricted ancestor apply. Processes that are reparented when
+// their restricted ancestor exits are no longer restricted. If an
+// ancestor cannot be read, the process is refused. It may be called
+// with a nil Allowlist.
+func (a *Allowlist) allowed(repo, p string, pid uint32) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.Lock()
+	empty := len(a.rules) == 0
+	a.mu.Unlock()
+	if empty || p == "" {
+		return true
+	}
+
+	for i := 0; pid > 1; i++ {
+		if i == maxProcDepth {
+			return false
+		}
+		tgid, ppid, err := procParent(pid)
+		if err != nil {
+			return false
+		}
+
+		a.mu.Lock()
+		rules, ok := a.rules[tgid]
+		a.mu.Unlock()
+		if ok {
+			for _, r := range rules {
+				if r.Repo != "" && r.Repo != repo {
+					continue
+				}
+				for _, pattern := range r.Paths {
+					if matchAllowed(pattern, p) {
+						return true
+					}
+				}
+			}
+			return false
+		}
+		pid = ppid
+	}
+	return true
+}
+
+// matchAllowed returns whether p is, is below or is a parent of a
+// path matching pattern.
+func matchAllowed(pattern, p string) bool {
+	pattern = strings.Trim(path.Clean(pattern), "/")
+	if pattern == "." || pattern == "" {
+		return true
+	}
+	pc := strings.Split(pattern, "/")
+	xc := strings.Split(p, "/")
+	for i := 0; i < len(pc) && i < len(xc); i++ {
+		if ok, _ := path.Match(pc[i], xc[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// procParent returns the process of a thread ID, and its parent
+// process. It is a variable for testing.
+var procParent = readProcParent
+
+// readProcParent implements procParent by reading /proc.
+func readProcParent(pid uint32) (tgid, ppid uint32, err error) {
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	found := 0
+	for _, l := range strings.Split(string(content), "\n") {
+		var dest *uint32
+		if strings.HasPrefix(l, "Tgid:") {
+			dest = &tgid
+		} else if strings.HasPrefix(l, "PPid:") {
+			dest = &ppid
+		} else {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(l[5:]), 10, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		*dest = uint32(n)
+		found++
+	}
+	if found != 2 {
+		return 0, 0, fmt.Errorf("/proc/%d/status: no Tgid or PPid", pid)
+	}
+	return tgid, ppid, nil
+}
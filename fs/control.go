@@ -0,0 +1,380 @@
+package fs
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	git "github.com/libgit2/git2go"
+)
+
+// ControlRequest is a call on the control socket. The protocol is a
+// stream of JSON objects: each ControlRequest is answered by a
+// ControlResponse on the same connection.
+type ControlRequest struct {
+	// Method is the method to call, eg. "AddMount".
+	Method string
+
+	// Path and Source are the arguments of the mount methods;
+	// see MultiGitFS.
+	Path   string `json:",omitempty"`
+	Source string `json:",omitempty"`
+
+	// Rule is the argument of AllowAdd, and Pid that of
+	// AllowRemove.
+	Rule *AllowRule `json:",omitempty"`
+	Pid  uint32     `json:",omitempty"`
+
+	// Targets and Parallel are the arguments of Warm.
+	Targets  []WarmTarget `json:",omitempty"`
+	Parallel int          `json:",omitempty"`
+}
+
+// ControlResponse is the result of a ControlRequest.
+type ControlResponse struct {
+	// Error is set if the call failed.
+	Error *ControlError `json:",omitempty"`
+
+	// Mounts is set by ListMounts.
+	Mounts []MountStatus `json:",omitempty"`
+
+	// Stats is set by Stats.
+	Stats map[string]int64 `json:",omitempty"`
+
+	// Trace is set by TraceDump and TraceStop.
+	Trace []TraceEntry `json:",omitempty"`
+
+	// Rules is set by AllowList.
+	Rules []AllowRule `json:",omitempty"`
+
+	// Warm is set by Warm.
+	Warm *WarmResult `json:",omitempty"`
+}
+
+// ControlError is a failed call on the control socket.
+type ControlError struct {
+	// Op and Path are the operation and path that failed, if
+	// known.
+	Op   string `json:",omitempty"`
+	Path string `json:",omitempty"`
+
+	// Errno is the errno value describing the failure, eg. 2,
+	// and Code its symbolic name, eg. "ENOENT", if known.
+	Errno int    `json:",omitempty"`
+	Code  string `json:",omitempty"`
+
+	Message string
+}
+
+func (e *ControlError) Error() string {
+	return e.Message
+}
+
+var errnoCodes = map[syscall.Errno]string{
+	syscall.EBUSY:   "EBUSY",
+	syscall.EEXIST:  "EEXIST",
+	syscall.EINVAL:  "EINVAL",
+	syscall.EIO:     "EIO",
+	syscall.ENOENT:  "ENOENT",
+	syscall.ENOSYS:  "ENOSYS",
+	syscall.ENOTDIR: "ENOTDIR",
+	syscall.EPERM:   "EPERM",
+}
+
+func newControlError(err error) *ControlError {
+	if e, ok := err.(*ControlError); ok {
+		return e
+	}
+	e := &ControlError{Message: err.Error()}
+	if pe, ok := err.(*os.PathError); ok {
+		e.Op = pe.Op
+		e.Path = pe.Path
+	}
+	if errno := errnoOf(err); errno != 0 {
+		e.Errno = int(errno)
+		e.Code = errnoCodes[errno]
+	}
+	return e
+}
+
+// errnoOf returns the errno describing err, or 0 if there is none.
+// Objects that git cannot find are reported as ENOENT.
+func errnoOf(err error) syscall.Errno {
+	switch e := err.(type) {
+	case syscall.Errno:
+		return e
+	case *os.PathError:
+		return errnoOf(e.Err)
+	}
+	if git.IsErrorCode(err, git.ErrNotFound) {
+		return syscall.ENOENT
+	}
+	return 0
+}
+
+// ControlHandler implements a method of the control socket.
+type ControlHandler func(req *ControlRequest) (*ControlResponse, error)
+
+// ControlServer serves the control socket of a running gitfs. The
+// methods it offers depend on what was registered; Stats is always
+// available.
+type ControlServer struct {
+	mu       sync.Mutex
+	handlers map[string]ControlHandler
+	stats    []func(stats map[string]int64)
+}
+
+// NewControlServer returns a ControlServer that only has the Stats
+// method.
+func NewControlServer() *ControlServer {
+	s := &ControlServer{handlers: map[string]ControlHandler{}}
+	s.Handle("Stats", s.statsHandler)
+	return s
+}
+
+// Handle registers the handler for a method.
+func (s *ControlServer) Handle(method string, h ControlHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = h
+}
+
+// AddStats registers a function that adds counters to the result
+// of the Stats method.
+func (s *ControlServer) AddStats(f func(stats map[string]int64)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats = append(s.stats, f)
+}
+
+func (s *ControlServer) statsHandler(req *ControlRequest) (*ControlResponse, error) {
+	s.mu.Lock()
+	funcs := s.stats
+	s.mu.Unlock()
+
+	stats := map[string]int64{}
+	for _, f := range funcs {
+		f(stats)
+	}
+	return &ControlResponse{Stats: stats}, nil
+}
+
+// HandleMounts registers ListMounts for a ManifestFS or MultiGitFS
+// root.
+func (s *ControlServer) HandleMounts(fs interface {
+	Mounts() []MountStatus
+}) {
+	s.Handle("ListMounts", func(req *ControlRequest) (*ControlResponse, error) {
+		return &ControlResponse{Mounts: fs.Mounts()}, nil
+	})
+	s.AddStats(func(stats map[string]int64) {
+		stats["mounts"] = int64(len(fs.Mounts()))
+	})
+}
+
+// HandleMultiGitFS registers ListMounts, AddMount, RemoveMount and
+// Retarget for a multi-repository filesystem.
+func (s *ControlServer) HandleMultiGitFS(fs MultiGitFS) {
+	s.HandleMounts(fs)
+	s.Handle("AddMount", func(req *ControlRequest) (*ControlResponse, error) {
+		return nil, fs.AddMount(req.Path, req.Source)
+	})
+	s.Handle("RemoveMount", func(req *ControlRequest) (*ControlResponse, error) {
+		return nil, fs.RemoveMount(req.Path)
+	})
+	s.Handle("Retarget", func(req *ControlRequest) (*ControlResponse, error) {
+		return nil, fs.Retarget(req.Path, req.Source)
+	})
+}
+
+// HandleReload registers Reload, which rereads the configuration,
+// eg. the manifest of a ManifestFS.
+func (s *ControlServer) HandleReload(reload func() error) {
+	s.Handle("Reload", func(req *ControlRequest) (*ControlResponse, error) {
+		return nil, reload()
+	})
+}
+
+// HandleTracer registers TraceStart, TraceStop and TraceDump, which
+// start a new trace, stop it, and return it.
+func (s *ControlServer) HandleTracer(t *Tracer) {
+	s.Handle("TraceStart", func(req *ControlRequest) (*ControlResponse, error) {
+		t.Start()
+		return nil, nil
+	})
+	s.Handle("TraceStop", func(req *ControlRequest) (*ControlResponse, error) {
+		t.Stop()
+		return &ControlResponse{Trace: t.Entries()}, nil
+	})
+	s.Handle("TraceDump", func(req *ControlRequest) (*ControlResponse, error) {
+		return &ControlResponse{Trace: t.Entries()}, nil
+	})
+}
+
+// HandleAllowlist registers AllowAdd, AllowRemove and AllowList,
+// which add a rule, remove the rules of a process, and list the
+// rules.
+func (s *ControlServer) HandleAllowlist(a *Allowlist) {
+	s.Handle("AllowAdd", func(req *ControlRequest) (*ControlResponse, error) {
+		if req.Rule == nil || req.Rule.Pid == 0 {
+			return nil, &ControlError{Op: req.Method, Errno: int(syscall.EINVAL), Code: "EINVAL", Message: "missing rule or PID"}
+		}
+		a.Add(*req.Rule)
+		return nil, nil
+	})
+	s.Handle("AllowRemove", func(req *ControlRequest) (*ControlResponse, error) {
+		a.Remove(req.Pid)
+		return nil, nil
+	})
+	s.Handle("AllowList", func(req *ControlRequest) (*ControlResponse, error) {
+		return &ControlResponse{Rules: a.Rules()}, nil
+	})
+}
+
+// HandleDiskCache registers FlushCache for the blob cache in dir,
+// which is GitFSOptions.TempDir, and adds its size to Stats.
+func (s *ControlServer) HandleDiskCache(dir string) {
+	s.Handle("FlushCache", func(req *ControlRequest) (*ControlResponse, error) {
+		return nil, flushDiskCache(dir)
+	})
+	s.AddStats(func(stats map[string]int64) {
+		files, bytes := diskCacheSize(dir)
+		stats["disk_cache_files"] = files
+		stats["disk_cache_bytes"] = bytes
+	})
+}
+
+func diskCacheSize(dir string) (files, bytes int64) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0
+	}
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() {
+			files++
+			bytes += fi.Size()
+		}
+	}
+	return files, bytes
+}
+
+// flushDiskCache removes the blobs cached in dir, which are named by
+// their SHA1. Open files are not affected; blobs are written again
+// when they are next opened. Temporary files of blobs that are being
+// written are left alone.
+func flushDiskCache(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() || !SHA1RE.MatchString(fi.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ControlServer) call(req *ControlRequest) *ControlResponse {
+	s.mu.Lock()
+	h := s.handlers[req.Method]
+	s.mu.Unlock()
+
+	if h == nil {
+		return &ControlResponse{Error: &ControlError{
+			Op:      req.Method,
+			Errno:   int(syscall.ENOSYS),
+			Code:    "ENOSYS",
+			Message: "unknown method " + req.Method,
+		}}
+	}
+
+	resp, err := h(req)
+	if resp == nil {
+		resp = &ControlResponse{}
+	}
+	if err != nil {
+		resp.Error = newControlError(err)
+	}
+	return resp
+}
+
+// Serve answers requests on connections accepted from l. It returns
+// when l fails, eg. because it was closed.
+func (s *ControlServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *ControlServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req ControlRequest
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				logger().Warningf("control request: %v", err)
+			}
+			return
+		}
+		if err := enc.Encode(s.call(&req)); err != nil {
+			logger().Warningf("control response: %v", err)
+			return
+		}
+	}
+}
+
+// ListenControl creates a Unix domain socket for the control server,
+// replacing a stale socket left by a previous run. The socket is
+// only accessible to the current user.
+func ListenControl(socket string) (net.Listener, error) {
+	if fi, err := os.Lstat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil, &os.PathError{Op: "listen", Path: socket, Err: syscall.EADDRINUSE}
+		}
+		os.Remove(socket)
+	}
+	// Restrict the socket as it is created; a chmod afterwards
+	// leaves a window for others to connect.
+	old := syscall.Umask(0177)
+	l, err := net.Listen("unix", socket)
+	syscall.Umask(old)
+	return l, err
+}
+
+// CallControl sends a request to the control socket of a running
+// gitfs. A failed call returns the response along with its Error.
+func CallControl(socket string, req *ControlRequest) (*ControlResponse, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return &resp, resp.Error
+	}
+	return &resp, nil
+}
@@ -1,13 +1,15 @@
 package fs
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 
 	git "github.com/libgit2/git2go"
 
@@ -18,34 +20,101 @@ import (
 type treeFS struct {
 	repo *git.Repository
 	opts GitFSOptions
+
+	// mu guards commit and the IDs of the directories, which
+	// change when the tree is retargeted.
+	mu sync.Mutex
+
+	// commit is the commit the tree was taken from, or nil if
+	// the tree was specified directly.
+	commit *git.Oid
+
+	objects *objectStore
+
+	// stats counts what recurse added to the tree.
+	stats treeStats
+
+	// prefetch limits the blobs loaded concurrently by prefetching,
+	// or is nil if prefetching is disabled.
+	prefetch chan struct{}
+
+	log *Logger
 }
 
 type GitFSOptions struct {
 	Lazy    bool
 	Disk    bool
 	TempDir string
+
+	// Tracer, if set, records the files that are accessed.
+	Tracer *Tracer
+
+	// Allowlist, if set, restricts what processes can see.
+	Allowlist *Allowlist
+
+	// Metrics, if set, counts operations.
+	Metrics *Metrics
+
+	// PrefetchWorkers, if positive, enables prefetching: the first
+	// time a directory is listed, or a file in it is opened, its
+	// other small blobs are loaded in the background, by at most
+	// this many workers per tree.
+	PrefetchWorkers int
+
+	// ObjectCacheSize caps the memory used to cache the small
+	// blobs of each repository. If zero, DefaultObjectCacheSize
+	// is used.
+	ObjectCacheSize int64
+}
+
+// NodefsOptions returns the options for mounting trees created with
+// these options. Trees create all their nodes when mounted, and look
+// up the known children themselves, so lookups can be traced and
+// restricted.
+func (o *GitFSOptions) NodefsOptions() *nodefs.Options {
+	opts := &nodefs.Options{
+		EntryTimeout:        time.Hour,
+		NegativeTimeout:     time.Hour,
+		AttrTimeout:         time.Hour,
+		PortableInodes:      true,
+		LookupKnownChildren: true,
+	}
+	if o != nil && o.Allowlist != nil {
+		// Lookups must reach us, to check every process.
+		opts.EntryTimeout = 0
+		opts.NegativeTimeout = 0
+	}
+	return opts
 }
 
-// NewTreeFS creates a git Tree FS. The treeish should resolve to tree SHA1.
-func NewTreeFSRoot(repo *git.Repository, treeish string, opts *GitFSOptions) (nodefs.Node, error) {
+// resolveTree returns the tree for treeish, and the commit it was
+// taken from, or nil if treeish names a tree.
+func resolveTree(repo *git.Repository, treeish string) (treeId, commitId *git.Oid, err error) {
 	obj, err := repo.RevparseSingle(treeish)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer obj.Free()
 
-	var treeId *git.Oid
 	switch obj.Type() {
 	case git.ObjectCommit:
 		commit, err := repo.LookupCommit(obj.Id())
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		treeId = commit.TreeId()
+		defer commit.Free()
+		return commit.TreeId(), obj.Id().Copy(), nil
 	case git.ObjectTree:
-		treeId = obj.Id()
-	default:
-		return nil, fmt.Errorf("gitfs: unsupported object type %d", obj.Type())
+		return obj.Id().Copy(), nil, nil
+	}
+	return nil, nil, fmt.Errorf("gitfs: unsupported object type %d", obj.Type())
+}
+
+// NewTreeFS creates a git Tree FS. The treeish should resolve to tree SHA1.
+func NewTreeFSRoot(repo *git.Repository, treeish string, opts *GitFSOptions) (nodefs.Node, error) {
+	treeId, commitId, err := resolveTree(repo, treeish)
+	if err != nil {
+		return nil, err
 	}
 
 	if opts == nil {
@@ -61,27 +130,105 @@ func NewTreeFSRoot(repo *git.Repository, treeish string, opts *GitFSOptions) (no
 		}
 	}
 
+	objects, err := openObjectStore(repo, opts)
+	if err != nil {
+		return nil, err
+	}
+
 	t := &treeFS{
-		repo: repo,
-		opts: *opts,
+		repo:    repo,
+		opts:    *opts,
+		commit:  commitId,
+		objects: objects,
+		log:     logger().With("repo", repoDir(repo), "treeish", treeish),
 	}
-	root := t.newDirNode(treeId)
+	if opts.PrefetchWorkers > 0 {
+		t.prefetch = make(chan struct{}, opts.PrefetchWorkers)
+	}
+	root := t.newDirNode(treeId, "")
 	return root, nil
 }
 
-func (t *treeFS) onMount(root *dirNode) {
-	tree, err := t.repo.LookupTree(root.id)
-	if err != nil {
-		panic(err)
+// setMountPath adds the mount path to the log messages of a root
+// returned by NewTreeFSRoot. It must be called before mounting.
+func setMountPath(n nodefs.Node, mount string) {
+	if root, ok := n.(*dirNode); ok {
+		root.fs.log = root.fs.log.With("mount", mount)
 	}
-	defer tree.Free()
+}
+
+// rootCommit returns the commit mounted at a root returned by
+// NewTreeFSRoot, or "" if it is not known.
+func rootCommit(n nodefs.Node) string {
+	if root, ok := n.(*dirNode); ok {
+		if _, commit := root.target(); commit != nil {
+			return commit.String()
+		}
+	}
+	return ""
+}
+
+// CommitXAttr is the extended attribute of the root of a tree with
+// the commit that is mounted, for single tree mounts, which have no
+// StatusFile.
+const CommitXAttr = "user.gitfs.commit"
+
+// StatusFile is the file in the .gitfs directory of a manifest mount
+// that lists the mounted trees. Each line has the mount path
+// (relative to the root), the source, and the commit, separated by
+// tabs.
+const StatusFile = ".gitfs/status"
+
+// StatsFile is the file in the .gitfs directory of a manifest mount
+// with the metrics as JSON, if GitFSOptions.Metrics is set.
+const StatsFile = ".gitfs/stats"
+
+// MountStatus describes a mounted tree.
+type MountStatus struct {
+	// Path is the mount point, relative to the root.
+	Path string
+
+	// Source is the REPO-DIR:TREEISH or directory that was
+	// mounted.
+	Source string
+
+	// Commit is the commit that was mounted, "error" if the
+	// tree could not be loaded, or empty if not known.
+	Commit string `json:",omitempty"`
+}
+
+// formatStatus formats mounts in the format of StatusFile.
+func formatStatus(mounts []MountStatus) []byte {
+	var buf bytes.Buffer
+	for _, m := range mounts {
+		commit := m.Commit
+		if commit == "" {
+			commit = "-"
+		}
+		fmt.Fprintf(&buf, "%s\t%s\t%s\n", m.Path, m.Source, commit)
+	}
+	return buf.Bytes()
+}
+
+func (t *treeFS) onMount(root *dirNode) {
 	if root.Inode() == nil {
 		panic("nil?")
 	}
-	t.recurse(tree, root)
+	// The store is only kept open while the tree is mounted, and
+	// may have been closed since the tree was built.
+	objects, err := t.objects.acquire(t.repo, &t.opts)
 	if err != nil {
 		panic(err)
 	}
+	t.objects = objects
+
+	// The root may have been mounted before, with other inodes.
+	t.stats.reset()
+	t.stats.add(1, 0)
+	id, _ := root.target()
+	if err := t.recurse(id, root, ""); err != nil {
+		panic(err)
+	}
 }
 
 type mutableLink struct {
@@ -100,18 +247,140 @@ func (n *mutableLink) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
 
 type gitNode struct {
 	fs *treeFS
+
+	// id may point into the listings of the object store, and
+	// must not be modified. The IDs of directories change when
+	// the tree is retargeted; read them with target.
 	id *git.Oid
+
+	// path is the path of the node in the tree, for tracing.
+	path string
 	nodefs.Node
 }
 
 type dirNode struct {
 	gitNode
+
+	// prefetched is set to 1 once the directory is prefetched.
+	prefetched int32
 }
 
 func (n *dirNode) OnMount(conn *nodefs.FileSystemConnector) {
 	n.fs.onMount(n)
 }
 
+func (n *dirNode) OnUnmount() {
+	n.fs.objects.release()
+}
+
+// target returns the ID of n, and the commit of its tree.
+func (n *gitNode) target() (id, commit *git.Oid) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	return n.id, n.fs.commit
+}
+
+// repoDir returns the directory of a repository, which is the work
+// tree for repositories that have one.
+func repoDir(repo *git.Repository) string {
+	dir := filepath.Clean(repo.Path())
+	if filepath.Base(dir) == ".git" {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// toGitNode returns the gitNode of a node in a tree, or nil.
+func toGitNode(n nodefs.Node) *gitNode {
+	switch c := n.(type) {
+	case *dirNode:
+		return &c.gitNode
+	case *blobNode:
+		return &c.gitNode
+	case *linkNode:
+		return &c.gitNode
+	}
+	return nil
+}
+
+func (n *gitNode) GetXAttr(attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	if attribute != CommitXAttr || n.path != "" {
+		return nil, fuse.ENODATA
+	}
+	_, commit := n.target()
+	if commit == nil {
+		return nil, fuse.ENODATA
+	}
+	return []byte(commit.String()), fuse.OK
+}
+
+// visible returns whether the client of an operation may see n.
+func (n *gitNode) visible(context *fuse.Context) bool {
+	return context == nil || n.fs.opts.Allowlist.allowed(repoDir(n.fs.repo), n.path, context.Pid)
+}
+
+// access is called for each operation on n. It returns false if the
+// client may not see n, and otherwise records the operation if
+// tracing.
+func (n *gitNode) access(op string, context *fuse.Context) bool {
+	if !n.visible(context) {
+		n.fs.log.With("path", n.path).Warningf("denied %s to pid %d", op, context.Pid)
+		return false
+	}
+	n.debug(op, context)
+	n.fs.opts.Tracer.record(n, op, context)
+	return true
+}
+
+// debug logs an operation on n, if debug logging is enabled for its
+// mount.
+func (n *gitNode) debug(op string, context *fuse.Context) {
+	if !n.fs.log.DebugEnabled() {
+		return
+	}
+	var pid uint32
+	if context != nil {
+		pid = context.Pid
+	}
+	n.fs.log.With("path", n.path).Debugf("%s by pid %d", op, pid)
+}
+
+func (n *dirNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	defer n.fs.opts.Metrics.observe(opLookup, time.Now())
+	ch := n.Inode().GetChild(name)
+	if ch == nil {
+		return nil, fuse.ENOENT
+	}
+	if g := toGitNode(ch.Node()); g != nil && !g.access("lookup", context) {
+		return nil, fuse.ENOENT
+	}
+	return ch, ch.Node().GetAttr(out, nil, context)
+}
+
+func (n *dirNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (code fuse.Status) {
+	defer n.fs.opts.Metrics.observe(opGetAttr, time.Now())
+	n.debug("getattr", context)
+	return n.Node.GetAttr(out, file, context)
+}
+
+func (n *dirNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	n.prefetch()
+	entries, code := n.Node.OpenDir(context)
+	if !code.Ok() || n.fs.opts.Allowlist == nil {
+		return entries, code
+	}
+	visible := entries[:0]
+	for _, e := range entries {
+		if ch := n.Inode().GetChild(e.Name); ch != nil {
+			if g := toGitNode(ch.Node()); g != nil && !g.visible(context) {
+				continue
+			}
+		}
+		visible = append(visible, e)
+	}
+	return visible, code
+}
+
 func (n *dirNode) Symlink(name string, content string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
 	l := &mutableLink{nodefs.NewDefaultNode(), []byte(content)}
 	return n.Inode().NewChild(name, false, l), fuse.OK
@@ -135,6 +404,9 @@ type blobNode struct {
 	gitNode
 	mode git.Filemode
 	size uint64
+
+	// dir is the directory containing the blob, or nil.
+	dir *dirNode
 }
 
 type linkNode struct {
@@ -143,70 +415,140 @@ type linkNode struct {
 }
 
 func (n *linkNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (code fuse.Status) {
+	defer n.fs.opts.Metrics.observe(opGetAttr, time.Now())
+	n.debug("getattr", context)
 	out.Mode = fuse.S_IFLNK
 	return fuse.OK
 }
 
 func (n *linkNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	defer n.fs.opts.Metrics.observe(opReadlink, time.Now())
+	if !n.access("readlink", c) {
+		return nil, fuse.ENOENT
+	}
 	return n.target, fuse.OK
 }
 
 func (n *blobNode) Open(flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	defer n.fs.opts.Metrics.observe(opOpen, time.Now())
 	if flags&fuse.O_ANYWRITE != 0 {
 		return nil, fuse.EPERM
 	}
+	if !n.access("open", context) {
+		return nil, fuse.ENOENT
+	}
+	if n.dir != nil {
+		n.dir.prefetch()
+	}
 
 	ctor := n.LoadMemory
 	if n.fs.opts.Disk {
 		ctor = n.LoadDisk
 	}
 
-	if !n.fs.opts.Lazy {
-		f, err := ctor()
-		if err != nil {
+	var f nodefs.File
+	if n.fs.opts.Lazy {
+		f = &lazyBlobFile{
+			ctor: ctor,
+			node: n,
+		}
+	} else {
+		var err error
+		if f, err = ctor(); err != nil {
 			return nil, fuse.ToStatus(err)
 		}
-		return f, fuse.OK
 	}
 
-	return &lazyBlobFile{
-		ctor: ctor,
-		node: n,
+	// The node is for a single blob, so its content never
+	// changes, and the kernel can keep what it read in earlier
+	// opens.
+	return &nodefs.WithFlags{
+		File:      n.instrument(f),
+		FuseFlags: fuse.FOPEN_KEEP_CACHE,
 	}, fuse.OK
 }
 
+// instrument returns f, counting and logging its reads if metrics
+// or debug logging are enabled.
+func (n *blobNode) instrument(f nodefs.File) nodefs.File {
+	if n.fs.opts.Metrics == nil && !n.fs.log.DebugEnabled() {
+		return f
+	}
+	return &instrumentedFile{File: f, node: n}
+}
+
+type instrumentedFile struct {
+	nodefs.File
+	node *blobNode
+}
+
+func (f *instrumentedFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	metrics := f.node.fs.opts.Metrics
+	defer metrics.observe(opRead, time.Now())
+	res, code := f.File.Read(dest, off)
+	if code.Ok() && res != nil {
+		metrics.served(res.Size())
+	}
+	if log := f.node.fs.log; log.DebugEnabled() {
+		log.With("path", f.node.path).Debugf("read %d bytes at %d: %v", len(dest), off, code)
+	}
+	return res, code
+}
+
+// lookupBlob is repo.LookupBlob, timed for the metrics.
+func (t *treeFS) lookupBlob(id *git.Oid) (*git.Blob, error) {
+	defer t.opts.Metrics.observeODB(time.Now())
+	return t.repo.LookupBlob(id)
+}
+
 func (n *blobNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (code fuse.Status) {
+	defer n.fs.opts.Metrics.observe(opGetAttr, time.Now())
+	n.debug("getattr", context)
 	out.Mode = uint32(n.mode)
 	out.Size = uint64(n.size)
 	return fuse.OK
 }
 
-func (t *treeFS) newLinkNode(id *git.Oid) (nodefs.Node, error) {
+func (t *treeFS) newLinkNode(id *git.Oid, path string) (nodefs.Node, error) {
 	n := &linkNode{
 		gitNode: gitNode{
 			fs:   t,
-			id:   id.Copy(),
+			id:   id,
+			path: path,
 			Node: nodefs.NewDefaultNode(),
 		},
 	}
 
-	blob, err := t.repo.LookupBlob(id)
+	target, err := t.objects.linkTarget(id)
 	if err != nil {
 		return nil, err
 	}
-	defer blob.Free()
-	n.target = append([]byte{}, blob.Contents()...)
+	n.target = target
 	return n, nil
 }
 
 func (n *blobNode) LoadMemory() (nodefs.File, error) {
-	blob, err := n.fs.repo.LookupBlob(n.id)
+	n.fs.opts.Metrics.blobLoad(false)
+	if n.size <= smallBlobSize {
+		data, ok, err := n.fs.objects.smallBlob(n.id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &memoryFile{
+				File: nodefs.NewDefaultFile(),
+				data: data,
+			}, nil
+		}
+	}
+	blob, err := n.fs.lookupBlob(n.id)
 	if err != nil {
 		return nil, err
 	}
 	return &memoryFile{
 		File: nodefs.NewDefaultFile(),
 		blob: blob,
+		data: blob.Contents(),
 	}, nil
 }
 
@@ -226,7 +568,7 @@ func (f *lazyBlobFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Statu
 	if f.File == nil {
 		g, err := f.ctor()
 		if err != nil {
-			log.Printf("opening blob for %s: %v", f.node.id.String(), err)
+			f.node.fs.log.With("path", f.node.path).Errorf("opening blob %s: %v", f.node.id.String(), err)
 			return nil, fuse.EIO
 		}
 		f.File = g
@@ -253,11 +595,17 @@ func (f *lazyBlobFile) Release() {
 
 type memoryFile struct {
 	nodefs.File
+
+	// blob is nil if data is shared with the object cache.
 	blob *git.Blob
+	data []byte
 }
 
 func (f *memoryFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
-	b := f.blob.Contents()
+	b := f.data
+	if off > int64(len(b)) {
+		off = int64(len(b))
+	}
 	end := off + int64(len(dest))
 	if end > int64(len(b)) {
 		end = int64(len(b))
@@ -266,45 +614,64 @@ func (f *memoryFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status)
 }
 
 func (f *memoryFile) Release() {
-	f.blob.Free()
+	if f.blob != nil {
+		f.blob.Free()
+	}
 }
 
 func (n *blobNode) LoadDisk() (nodefs.File, error) {
-	p := filepath.Join(n.fs.opts.TempDir, n.id.String())
-	if _, err := os.Lstat(p); os.IsNotExist(err) {
-		blob, err := n.fs.repo.LookupBlob(n.id)
-		if err != nil {
-			return nil, err
-		}
-		defer blob.Free()
-
-		// TODO - atomic, use content store to share content.
-		if err := ioutil.WriteFile(p, blob.Contents(), 0644); err != nil {
-			return nil, err
-		}
+	n.fs.opts.Metrics.blobLoad(true)
+	p, hit, err := n.fs.objects.cacheOnDisk(n.fs.opts.TempDir, n.id)
+	if err != nil {
+		return nil, err
 	}
+	n.fs.opts.Metrics.diskCache(hit)
 	f, err := os.Open(p)
 	if err != nil {
 		return nil, err
 	}
 
-	return nodefs.NewLoopbackFile(f), nil
+	return &diskFile{
+		File: nodefs.NewDefaultFile(),
+		f:    f,
+		size: int64(n.size),
+	}, nil
+}
+
+// diskFile reads a blob from the disk cache. Reads return the file
+// descriptor and offset, so the data can be spliced to the kernel
+// without copying it through gitfs.
+type diskFile struct {
+	nodefs.File
+	f    *os.File
+	size int64
+}
+
+func (f *diskFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	sz := int64(len(dest))
+	if off+sz > f.size {
+		sz = f.size - off
+	}
+	if sz < 0 {
+		sz = 0
+	}
+	return fuse.ReadResultFd(f.f.Fd(), off, int(sz)), fuse.OK
+}
+
+func (f *diskFile) Release() {
+	f.f.Close()
 }
 
-func (t *treeFS) newBlobNode(id *git.Oid, mode git.Filemode) (nodefs.Node, error) {
+func (t *treeFS) newBlobNode(id *git.Oid, mode git.Filemode, path string) (nodefs.Node, error) {
 	n := &blobNode{
 		gitNode: gitNode{
 			fs:   t,
-			id:   id.Copy(),
+			id:   id,
+			path: path,
 			Node: nodefs.NewDefaultNode(),
 		},
 	}
-	odb, err := t.repo.Odb()
-	if err != nil {
-		return nil, err
-	}
-	defer odb.Free()
-	sz, _, err := odb.ReadHeader(id)
+	sz, err := t.objects.size(id)
 	if err != nil {
 		return nil, err
 	}
@@ -314,50 +681,65 @@ func (t *treeFS) newBlobNode(id *git.Oid, mode git.Filemode) (nodefs.Node, error
 	return n, nil
 }
 
-func (t *treeFS) newDirNode(id *git.Oid) nodefs.Node {
+func (t *treeFS) newDirNode(id *git.Oid, path string) nodefs.Node {
 	n := &dirNode{
 		gitNode: gitNode{
 			fs:   t,
-			id:   id.Copy(),
+			id:   id,
+			path: path,
 			Node: nodefs.NewDefaultNode(),
 		},
 	}
 	return n
 }
 
-func (t *treeFS) recurse(tree *git.Tree, n nodefs.Node) error {
-	for i := uint64(0); ; i++ {
-		e := tree.EntryByIndex(i)
-		if e == nil {
-			break
-		}
-		isdir := e.Filemode&syscall.S_IFDIR != 0
-		var chNode nodefs.Node
-		if isdir {
-			chNode = t.newDirNode(e.Id)
-		} else if e.Filemode&^07777 == syscall.S_IFLNK {
-			l, err := t.newLinkNode(e.Id)
-			if err != nil {
-				return err
-			}
-			chNode = l
-		} else if e.Filemode&^07777 == syscall.S_IFREG {
-			b, err := t.newBlobNode(e.Id, e.Filemode)
-			if err != nil {
-				return err
-			}
-			chNode = b
-		} else {
-			panic(e)
+// newChild creates the node for the entry e of the directory n, at
+// path p.
+func (t *treeFS) newChild(e *treeEntry, n nodefs.Node, p string) (nodefs.Node, error) {
+	if e.isDir() {
+		return t.newDirNode(&e.id, p), nil
+	}
+	switch e.mode &^ 07777 {
+	case syscall.S_IFLNK:
+		return t.newLinkNode(&e.id, p)
+	case syscall.S_IFREG:
+		b, err := t.newBlobNode(&e.id, e.mode, p)
+		if err != nil {
+			return nil, err
 		}
-		n.Inode().NewChild(e.Name, isdir, chNode)
-		if isdir {
-			tree, err := t.repo.LookupTree(e.Id)
-			if err != nil {
-				return err
-			}
+		b.(*blobNode).dir, _ = n.(*dirNode)
+		return b, nil
+	}
+	panic(e)
+}
+
+// nodeBytes returns the size that the stats count for a node.
+func nodeBytes(n nodefs.Node) int64 {
+	switch c := n.(type) {
+	case *blobNode:
+		return int64(c.size)
+	case *linkNode:
+		return int64(len(c.target))
+	}
+	return 0
+}
 
-			if err := t.recurse(tree, chNode); err != nil {
+func (t *treeFS) recurse(id *git.Oid, n nodefs.Node, dir string) error {
+	entries, err := t.objects.tree(id)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		e := &entries[i]
+		p := path.Join(dir, e.name)
+		chNode, err := t.newChild(e, n, p)
+		if err != nil {
+			return err
+		}
+		n.Inode().NewChild(e.name, e.isDir(), chNode)
+		t.stats.add(1, nodeBytes(chNode))
+		if e.isDir() {
+			if err := t.recurse(&e.id, chNode, p); err != nil {
 				return nil
 			}
 		}
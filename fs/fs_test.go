@@ -1,12 +1,18 @@
 package fs
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/hanwen/gitfs/manifest"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 
@@ -99,7 +105,7 @@ func setupBasic(opts *GitFSOptions) (*testCase, error) {
 		return nil, err
 	}
 
-	root, err := NewTreeFSRoot(repo, "refs/heads/master", nil)
+	root, err := NewTreeFSRoot(repo, "refs/heads/master", opts)
 	if err != nil {
 		return nil, err
 	}
@@ -109,7 +115,7 @@ func setupBasic(opts *GitFSOptions) (*testCase, error) {
 		return nil, err
 	}
 
-	server, _, err := nodefs.MountRoot(mnt, root, nil)
+	server, _, err := nodefs.MountRoot(mnt, root, opts.NodefsOptions())
 	server.SetDebug(true)
 	go server.Serve()
 	if err != nil {
@@ -143,6 +149,518 @@ func TestBasicLazy(t *testing.T) {
 	testGitFS(tc.mnt, t)
 }
 
+func TestCommitXAttr(t *testing.T) {
+	tc, err := setupBasic(nil)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	master, err := tc.repo.RevparseSingle("master")
+	if err != nil {
+		t.Fatalf("RevparseSingle: %v", err)
+	}
+	defer master.Free()
+
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(tc.mnt, CommitXAttr, buf)
+	if got, want := string(buf[:n]), master.Id().String(); err != nil || got != want {
+		t.Errorf("Getxattr(root): got %q, %v, want %q", got, err, want)
+	}
+	if _, err := syscall.Getxattr(tc.mnt+"/file", CommitXAttr, buf); err != syscall.ENODATA {
+		t.Errorf("Getxattr(file): got %v, want ENODATA", err)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tc, err := setupBasic(&GitFSOptions{Lazy: true, Disk: true, TempDir: dir})
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	for i := 0; i < 2; i++ {
+		if c, err := ioutil.ReadFile(tc.mnt + "/file"); err != nil || string(c) != "hello" {
+			t.Fatalf("ReadFile: %q, %v", c, err)
+		}
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("got disk cache %v, want one blob", names)
+	}
+	if c, err := ioutil.ReadFile(names[0]); err != nil || string(c) != "hello" {
+		t.Errorf("cached blob %q, %v", c, err)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	metrics := NewMetrics()
+	tc, err := setupBasic(&GitFSOptions{Lazy: true, Metrics: metrics, PrefetchWorkers: 2})
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	if _, err := ioutil.ReadDir(tc.mnt); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for i := 0; metrics.Snapshot().PrefetchedBlobs == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := metrics.Snapshot().PrefetchedBlobs; n != 1 {
+		t.Fatalf("prefetched %d blobs, want 1", n)
+	}
+
+	hits := metrics.Snapshot().ObjectCacheHits
+	if c, err := ioutil.ReadFile(tc.mnt + "/file"); err != nil || string(c) != "hello" {
+		t.Fatalf("ReadFile: %q, %v", c, err)
+	}
+	if metrics.Snapshot().ObjectCacheHits == hits {
+		t.Errorf("read of prefetched file missed the object cache")
+	}
+}
+
+func TestWarm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	repo, err := setupRepo(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatalf("setupRepo: %v", err)
+	}
+	defer repo.Free()
+
+	cache := filepath.Join(dir, "cache")
+	if err := os.Mkdir(cache, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	opts := &GitFSOptions{Lazy: true, Disk: true, TempDir: cache}
+	root, err := NewTreeFSRoot(repo, "refs/heads/master", opts)
+	if err != nil {
+		t.Fatalf("NewTreeFSRoot: %v", err)
+	}
+	mnt := filepath.Join(dir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	server, conn, err := nodefs.MountRoot(mnt, root, nil)
+	if err != nil {
+		t.Fatalf("MountRoot: %v", err)
+	}
+	go server.Serve()
+	defer server.Unmount()
+
+	entries, err := root.(*dirNode).fs.objects.tree(root.(*dirNode).id)
+	if err != nil {
+		t.Fatalf("tree: %v", err)
+	}
+	var id string
+	for _, e := range entries {
+		if e.name == "file" {
+			id = e.id.String()
+		}
+	}
+
+	res := Warm(conn, root, opts, []WarmTarget{
+		{Path: "file"},
+		{Path: "dir"},
+		{Path: "/dir/subfile"},
+		{Path: "nonexistent"},
+		{Repo: repoDir(repo), ID: id},
+		{Repo: "/nonexistent", ID: id},
+	}, 2)
+	if res.Blobs != 1 || res.Bytes != 5 || len(res.Errors) != 2 {
+		t.Errorf("got %+v, want 1 blob of 5 bytes, 2 errors", res)
+	}
+	if c, err := ioutil.ReadFile(filepath.Join(cache, id)); err != nil || string(c) != "hello" {
+		t.Errorf("cached blob %q, %v", c, err)
+	}
+	odb, err := repo.Odb()
+	if err != nil {
+		t.Fatalf("Odb: %v", err)
+	}
+	big, err := odb.Write(make([]byte, smallBlobSize+1), git.ObjectBlob)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	res = Warm(conn, root, &GitFSOptions{}, []WarmTarget{{Repo: repoDir(repo), ID: big.String()}}, 2)
+	if res.Blobs != 0 || res.Skipped != 1 || len(res.Errors) != 0 {
+		t.Errorf("got %+v, want 1 skipped blob", res)
+	}
+}
+
+func TestStatFs(t *testing.T) {
+	tc, err := setupBasic(nil)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(tc.mnt, &st); err != nil {
+		t.Fatalf("Statfs: %v", err)
+	}
+	// root, dir, dir/subfile, file and link, each 5 bytes.
+	if used := st.Files - st.Ffree; used != 5 {
+		t.Errorf("got %d inodes used, want 5", used)
+	}
+	if used := st.Blocks - st.Bfree; used != 1 {
+		t.Errorf("got %d blocks used, want 1", used)
+	}
+}
+
+func TestMultiFSStatFs(t *testing.T) {
+	tc, multi, err := setupMulti()
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	for _, p := range []string{"a", "sub/b"} {
+		if err := multi.AddMount(p, tc.repo.Path()+":master"); err != nil {
+			t.Fatalf("AddMount(%q): %v", p, err)
+		}
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(tc.mnt, &st); err != nil {
+		t.Fatalf("Statfs: %v", err)
+	}
+	if used := st.Files - st.Ffree; used != 10 {
+		t.Errorf("got %d inodes used, want 10", used)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	tracer := NewTracer()
+	tc, err := setupBasic(&GitFSOptions{Lazy: true, Tracer: tracer})
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	tracer.Start()
+	// Stats of nodes created at mount reach gitfs as lookups of
+	// known children.
+	if _, err := os.Lstat(tc.mnt + "/dir"); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if _, err := ioutil.ReadFile(tc.mnt + "/dir/subfile"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if _, err := os.Readlink(tc.mnt + "/link"); err != nil {
+		t.Fatalf("Readlink: %v", err)
+	}
+	tracer.Stop()
+	if _, err := ioutil.ReadFile(tc.mnt + "/file"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	got := map[string]string{}
+	for _, e := range tracer.Entries() {
+		if e.Repo != filepath.Dir(filepath.Clean(tc.repo.Path())) || len(e.Pids) == 0 || len(e.Commit) != 40 {
+			t.Errorf("bad entry %#v", e)
+		}
+		got[e.Path] = strings.Join(e.Ops, ",")
+	}
+	want := map[string]string{
+		"dir":         "lookup",
+		"dir/subfile": "lookup,open",
+		"link":        "lookup,readlink",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	allow := NewAllowlist()
+	tc, err := setupBasic(&GitFSOptions{Lazy: true, Allowlist: allow})
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	allow.Add(AllowRule{Pid: uint32(os.Getpid()), Paths: []string{"d*/sub*"}})
+	if _, err := os.Lstat(tc.mnt + "/file"); !os.IsNotExist(err) {
+		t.Errorf("Lstat(file): got %v, want ENOENT", err)
+	}
+	if content, err := ioutil.ReadFile(tc.mnt + "/dir/subfile"); err != nil || string(content) != "hello" {
+		t.Errorf("ReadFile(dir/subfile): got %q, %v", content, err)
+	}
+	entries, err := ioutil.ReadDir(tc.mnt)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "dir" {
+		t.Errorf("ReadDir: got %v, want [dir]", entries)
+	}
+
+	allow.Remove(uint32(os.Getpid()))
+	if _, err := os.Lstat(tc.mnt + "/link"); err != nil {
+		t.Errorf("Lstat(link) without rules: %v", err)
+	}
+}
+
+func TestAllowlistProcError(t *testing.T) {
+	defer func(f func(uint32) (uint32, uint32, error)) { procParent = f }(procParent)
+	procParent = func(pid uint32) (uint32, uint32, error) {
+		return 0, 0, os.ErrNotExist
+	}
+
+	allow := NewAllowlist()
+	if !allow.allowed("", "file", 1234) {
+		t.Errorf("refused without rules")
+	}
+	allow.Add(AllowRule{Pid: 1, Paths: []string{"file"}})
+	if allow.allowed("", "file", 1234) {
+		t.Errorf("allowed with unreadable ancestor")
+	}
+
+	// A process whose ancestors never end.
+	procParent = func(pid uint32) (uint32, uint32, error) {
+		return pid, pid + 1, nil
+	}
+	if allow.allowed("", "file", 1234) {
+		t.Errorf("allowed beyond maxProcDepth")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	tc, err := setupBasic(&GitFSOptions{Lazy: true, Metrics: metrics})
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	testGitFS(tc.mnt, t)
+
+	s := metrics.Snapshot()
+	// file, dir, dir/subfile and link are looked up.
+	if s.Ops["lookup"].Count < 4 || s.Ops["open"].Count != 1 || s.Ops["read"].Count == 0 {
+		t.Errorf("got ops %v", s.Ops)
+	}
+	if s.MemoryBlobLoads != 1 || s.DiskBlobLoads != 0 || s.ReadBytes != 5 {
+		t.Errorf("got %d memory loads, %d disk loads, %d bytes, want 1, 0, 5", s.MemoryBlobLoads, s.DiskBlobLoads, s.ReadBytes)
+	}
+
+	var buf bytes.Buffer
+	s.WritePrometheus(&buf)
+	if !strings.Contains(buf.String(), "\ngitfs_read_bytes_total 5\n") {
+		t.Errorf("Prometheus output lacks read bytes:\n%s", buf.String())
+	}
+}
+
+func TestObjectCache(t *testing.T) {
+	c := newObjectCache(3*objectOverhead + 11)
+	ids := make([]git.Oid, 4)
+	for i := range ids {
+		ids[i][0] = byte(i)
+	}
+
+	c.add(ids[0], 5, []byte("hello"))
+	c.add(ids[1], 100, nil)
+	c.add(ids[2], 5, []byte("world"))
+	if _, ok := c.get(ids[0]); !ok {
+		t.Fatalf("entry 0 evicted early")
+	}
+
+	// 1 is now the least recently used.
+	c.add(ids[3], 1, []byte("x"))
+	if _, ok := c.get(ids[1]); ok {
+		t.Errorf("entry 1 not evicted")
+	}
+	for _, i := range []int{0, 2, 3} {
+		if _, ok := c.get(ids[i]); !ok {
+			t.Errorf("entry %d evicted", i)
+		}
+	}
+	if e, _ := c.get(ids[0]); string(e.data) != "hello" || e.size != 5 {
+		t.Errorf("got entry %v", e)
+	}
+
+	// Adding a size does not drop the contents.
+	c.add(ids[2], 5, nil)
+	if e, _ := c.get(ids[2]); string(e.data) != "world" {
+		t.Errorf("contents dropped: %v", e)
+	}
+	if c.used > c.max {
+		t.Errorf("used %d > max %d", c.used, c.max)
+	}
+
+	// Listings count against the cap too.
+	c.addTree(ids[1], []treeEntry{{name: strings.Repeat("x", 100)}})
+	if e, ok := c.get(ids[1]); !ok || len(e.tree) != 1 {
+		t.Errorf("got tree entry %v", e)
+	}
+	if c.used > c.max || c.lru.Len() != 1 {
+		t.Errorf("used %d of %d by %d entries, want only the tree", c.used, c.max, c.lru.Len())
+	}
+}
+
+func TestFlushDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	blob := strings.Repeat("a", 40)
+	for _, n := range []string{blob, ".tmp123", "other"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, n), []byte("hello"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	if err := flushDiskCache(dir); err != nil {
+		t.Fatalf("flushDiskCache: %v", err)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	if want := []string{".tmp123", "other"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+}
+
+func TestSharedObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	repo, err := setupRepo(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatalf("setupRepo: %v", err)
+	}
+	defer repo.Free()
+	other, err := git.OpenRepository(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatalf("OpenRepository: %v", err)
+	}
+	defer other.Free()
+
+	var roots []*dirNode
+	for _, r := range []*git.Repository{repo, other} {
+		root, err := NewTreeFSRoot(r, "refs/heads/master", nil)
+		if err != nil {
+			t.Fatalf("NewTreeFSRoot: %v", err)
+		}
+		roots = append(roots, root.(*dirNode))
+	}
+	// Trees that are not mounted borrow their repository, and
+	// hold nothing open.
+	for _, root := range roots {
+		if !root.fs.objects.borrowed {
+			t.Errorf("store of unmounted tree is not borrowed")
+		}
+	}
+	if findObjectStore(repoDir(repo)) != nil {
+		t.Errorf("store registered before mounting")
+	}
+
+	// Mounting takes the references, which keep the shared store
+	// open.
+	for _, root := range roots {
+		if root.fs.objects, err = root.fs.objects.acquire(root.fs.repo, &root.fs.opts); err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+	}
+	objects := roots[0].fs.objects
+	if roots[1].fs.objects != objects || objects.borrowed {
+		t.Fatalf("trees of the same repository have different object stores")
+	}
+
+	var listings [][]treeEntry
+	for _, root := range roots {
+		entries, err := root.fs.objects.tree(root.id)
+		if err != nil {
+			t.Fatalf("tree: %v", err)
+		}
+		listings = append(listings, entries)
+	}
+	if len(listings[0]) != 3 || &listings[0][0] != &listings[1][0] {
+		t.Errorf("listings not shared: %v, %v", listings[0], listings[1])
+	}
+
+	for _, root := range roots {
+		root.OnUnmount()
+	}
+	objectStores.Lock()
+	s := objectStores.m[objects.dir]
+	objectStores.Unlock()
+	if s != nil {
+		t.Errorf("store still registered after unmounting all trees")
+	}
+	if _, err := objects.tree(roots[0].id); err != errStoreClosed {
+		t.Errorf("tree after closing: got %v, want errStoreClosed", err)
+	}
+
+	// Mounting again opens a new store.
+	if roots[0].fs.objects, err = objects.acquire(roots[0].fs.repo, &roots[0].fs.opts); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer roots[0].OnUnmount()
+	if roots[0].fs.objects == objects {
+		t.Errorf("closed store reused")
+	}
+	if _, err := roots[0].fs.objects.tree(roots[0].id); err != nil {
+		t.Errorf("tree after reopening: %v", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, &LoggerOptions{
+		Level:       LevelDebug,
+		JSON:        true,
+		DebugMounts: []string{"platform/*"},
+	})
+
+	l.With("mount", "external/zlib").Debugf("hidden")
+	m := l.With("repo", "/r", "mount", "external/zlib").With("mount", "platform/build")
+	m.Debugf("lookup %s", "a")
+
+	var got map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", buf.String(), err)
+	}
+	delete(got, "time")
+	want := map[string]string{
+		"level": "DEBUG",
+		"msg":   "lookup a",
+		"repo":  "/r",
+		"mount": "platform/build",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	buf.Reset()
+	l = NewLogger(&buf, &LoggerOptions{Level: LevelWarning})
+	l.Infof("hidden")
+	l.With("mount", "a b").Warningf("denied")
+	if s := buf.String(); !strings.HasSuffix(s, " WARNING denied mount=\"a b\"\n") {
+		t.Errorf("got %q", s)
+	}
+}
+
 func TestSymlink(t *testing.T) {
 	tc, err := setupBasic(nil)
 	if err != nil {
@@ -207,42 +725,56 @@ func testGitFS(mnt string, t *testing.T) {
 	}
 }
 
-func setupMulti() (*testCase, error) {
+func setupMulti() (*testCase, MultiGitFS, error) {
 	dir, err := ioutil.TempDir("", "fs_test")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	repo, err := setupRepo(filepath.Join(dir, "repo"))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	root := NewMultiGitFSRoot(nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	mnt := filepath.Join(dir, "mnt")
 	if err := os.Mkdir(mnt, 0755); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	server, _, err := nodefs.MountRoot(mnt, root, nil)
 	go server.Serve()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	return &testCase{
 		repo,
 		server,
 		mnt,
-	}, nil
+	}, root, nil
+}
+
+// retry calls f until it succeeds, for a second at most. Unmounting
+// fails while the kernel has not released the files of the tree,
+// which happens asynchronously after they are closed.
+func retry(f func() error) error {
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
 }
 
 func TestMultiFS(t *testing.T) {
-	tc, err := setupMulti()
+	tc, _, err := setupMulti()
 	if err != nil {
 		t.Fatalf("setup: %v", err)
 	}
@@ -273,8 +805,7 @@ func TestMultiFS(t *testing.T) {
 
 	// Ugh. the RELEASE opcode is not synchronized, so it
 	// may not be completed while we try the unmount.
-	time.Sleep(time.Millisecond)
-	if err := os.Remove(tc.mnt + "/config/sub/repo"); err != nil {
+	if err := retry(func() error { return os.Remove(tc.mnt + "/config/sub/repo") }); err != nil {
 		t.Fatalf("Remove: %v", err)
 	}
 
@@ -282,3 +813,483 @@ func TestMultiFS(t *testing.T) {
 		t.Errorf("repo is still there.")
 	}
 }
+
+func TestMultiFSControl(t *testing.T) {
+	tc, root, err := setupMulti()
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	socket := filepath.Join(filepath.Dir(tc.mnt), "control")
+	l, err := ListenControl(socket)
+	if err != nil {
+		t.Fatalf("ListenControl: %v", err)
+	}
+	defer l.Close()
+	if fi, err := os.Stat(socket); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Stat(socket): got %v, %v, want mode 0600", fi.Mode(), err)
+	}
+	ctl := NewControlServer()
+	ctl.HandleMultiGitFS(root)
+	go ctl.Serve(l)
+
+	source := tc.repo.Path() + ":master"
+	if _, err := CallControl(socket, &ControlRequest{Method: "AddMount", Path: "sub/repo", Source: source}); err != nil {
+		t.Fatalf("AddMount: %v", err)
+	}
+	testGitFS(tc.mnt+"/sub/repo", t)
+	if target, err := os.Readlink(tc.mnt + "/config/sub/repo"); err != nil || target != source {
+		t.Errorf("Readlink: got %q, %v, want %q", target, err, source)
+	}
+
+	_, err = CallControl(socket, &ControlRequest{Method: "AddMount", Path: "sub/repo", Source: source})
+	if e, ok := err.(*ControlError); !ok || e.Code != "EEXIST" || e.Path != "sub/repo" {
+		t.Errorf("AddMount again: got %#v, want EEXIST", err)
+	}
+	_, err = CallControl(socket, &ControlRequest{Method: "Retarget", Path: "sub/repo", Source: tc.repo.Path() + ":nonexistent"})
+	if e, ok := err.(*ControlError); !ok || e.Code != "ENOENT" || !strings.Contains(e.Message, "nonexistent") {
+		t.Errorf("Retarget to bad treeish: got %#v, want ENOENT naming the treeish", err)
+	}
+	_, err = CallControl(socket, &ControlRequest{Method: "Frobnicate"})
+	if e, ok := err.(*ControlError); !ok || e.Code != "ENOSYS" {
+		t.Errorf("unknown method: got %#v, want ENOSYS", err)
+	}
+
+	resp, err := CallControl(socket, &ControlRequest{Method: "ListMounts"})
+	if err != nil {
+		t.Fatalf("ListMounts: %v", err)
+	}
+	if len(resp.Mounts) != 1 || resp.Mounts[0].Path != "sub/repo" || resp.Mounts[0].Source != source || len(resp.Mounts[0].Commit) != 40 {
+		t.Errorf("ListMounts: got %v", resp.Mounts)
+	}
+
+	if err := retry(func() error {
+		_, err := CallControl(socket, &ControlRequest{Method: "RemoveMount", Path: "sub/repo"})
+		return err
+	}); err != nil {
+		t.Fatalf("RemoveMount: %v", err)
+	}
+	if _, err := os.Lstat(tc.mnt + "/sub/repo"); err == nil {
+		t.Errorf("repo is still there.")
+	}
+}
+
+const testManifest = `<?xml version="1.0" encoding="UTF-8"?>
+<manifest>
+  <default revision="master" />
+  <project path="build" name="platform/build">
+    <copyfile src="file" dest="Makefile" />
+    <linkfile src="dir/subfile" dest="sub/link" />
+  </project>
+</manifest>`
+
+func setupManifest(xml string, opts *ManifestFSOptions) (*testCase, ManifestFS, error) {
+	dir, err := ioutil.TempDir("", "fs_test")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repo, err := setupRepo(filepath.Join(dir, "projects", "build.git"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m, err := manifest.Parse([]byte(xml))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root, err := NewManifestFS(m, dir, opts, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mnt := filepath.Join(dir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	server, _, err := nodefs.MountRoot(mnt, root, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	go server.Serve()
+
+	return &testCase{
+		repo,
+		server,
+		mnt,
+	}, root, nil
+}
+
+func TestManifestFS(t *testing.T) {
+	tc, _, err := setupManifest(testManifest, nil)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	testGitFS(tc.mnt+"/build", t)
+
+	if content, err := ioutil.ReadFile(tc.mnt + "/Makefile"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+
+	want := "../build/dir/subfile"
+	if content, err := os.Readlink(tc.mnt + "/sub/link"); err != nil {
+		t.Fatalf("Readlink: %v", err)
+	} else if content != want {
+		t.Errorf("got %q, want %q", content, want)
+	}
+
+	if content, err := ioutil.ReadFile(tc.mnt + "/sub/link"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+	if err := os.Remove(tc.mnt + "/sub/link"); err == nil {
+		t.Errorf("removed linkfile")
+	}
+
+	master, err := tc.repo.RevparseSingle("master")
+	if err != nil {
+		t.Fatalf("RevparseSingle: %v", err)
+	}
+	defer master.Free()
+
+	pinned, err := manifest.ParseFile(filepath.Join(tc.mnt, PinnedManifestPath))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	if len(pinned.Project) != 1 {
+		t.Fatalf("got %v, want 1 project", pinned.Project)
+	}
+	if got, want := pinned.Project[0].Revision, master.Id().String(); got != want {
+		t.Errorf("got revision %q, want %q", got, want)
+	}
+	if got := pinned.Project[0].Upstream; got != "master" {
+		t.Errorf("got upstream %q, want %q", got, "master")
+	}
+}
+
+func TestProjectTreeish(t *testing.T) {
+	m := &manifest.Manifest{
+		Remote:  []manifest.Remote{{Name: "aosp"}},
+		Default: manifest.Default{Revision: "master"},
+	}
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	for rev, want := range map[string]string{
+		"":                "aosp/master",
+		"release":         "aosp/release",
+		"refs/heads/next": "aosp/next",
+		"refs/tags/v1.0":  "refs/tags/v1.0",
+		sha:               sha,
+	} {
+		p := &manifest.Project{Name: "p", Path: "p", Revision: rev}
+		if got := ProjectTreeish(m, p); got != want {
+			t.Errorf("ProjectTreeish(%q) = %q, want %q", rev, got, want)
+		}
+	}
+}
+
+func TestManifestFSFileConflict(t *testing.T) {
+	xml := `<manifest>
+  <default revision="master" />
+  <project path="build" name="platform/build">
+    <copyfile src="file" dest="build/Makefile" />
+  </project>
+</manifest>`
+	if tc, _, err := setupManifest(xml, nil); err == nil {
+		tc.Cleanup()
+		t.Fatalf("copyfile into project succeeded")
+	}
+}
+
+const brokenManifest = `<manifest>
+  <default revision="master" />
+  <project path="build" name="platform/build">
+    <copyfile src="file" dest="Makefile" />
+  </project>
+  <project path="missing" name="platform/missing">
+    <copyfile src="file" dest="Makefile.missing" />
+  </project>
+</manifest>`
+
+func TestManifestFSBroken(t *testing.T) {
+	tc, _, err := setupManifest(brokenManifest, nil)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	testGitFS(tc.mnt+"/build", t)
+
+	for _, n := range []string{"missing/" + ErrorFileName, "Makefile.missing"} {
+		if content, err := ioutil.ReadFile(filepath.Join(tc.mnt, n)); err != nil {
+			t.Errorf("ReadFile(%q): %v", n, err)
+		} else if len(content) == 0 {
+			t.Errorf("%q is empty", n)
+		}
+	}
+
+	pinned, err := manifest.ParseFile(filepath.Join(tc.mnt, PinnedManifestPath))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	for _, p := range pinned.Project {
+		broken := len(p.Annotation) == 1 && p.Annotation[0].Name == LoadErrorAnnotation
+		if want := p.Name == "platform/missing"; broken != want {
+			t.Errorf("project %s: got annotations %v, want load error %v", p.Name, p.Annotation, want)
+		}
+	}
+}
+
+func TestManifestFSPinnedSubproject(t *testing.T) {
+	tc, _, err := setupManifest(`<manifest>
+  <default revision="master" />
+  <project path="build" name="platform/build">
+    <project path="soong" name="soong" />
+  </project>
+</manifest>`, nil)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	pinned, err := manifest.ParseFile(filepath.Join(tc.mnt, PinnedManifestPath))
+	if err != nil {
+		t.Fatalf("ParseFile: %v", err)
+	}
+	if len(pinned.Project) != 1 || len(pinned.Project[0].Project) != 1 {
+		t.Fatalf("got %v, want 1 project with 1 subproject", pinned.Project)
+	}
+	if sub := pinned.Project[0].Project[0]; sub.Name != "soong" || sub.Path != "soong" {
+		t.Errorf("got subproject %q at %q, want soong at soong", sub.Name, sub.Path)
+	}
+}
+
+func TestManifestFSBrokenStrict(t *testing.T) {
+	if tc, _, err := setupManifest(brokenManifest, &ManifestFSOptions{Strict: true}); err == nil {
+		tc.Cleanup()
+		t.Fatalf("strict mode accepted missing project")
+	}
+}
+
+func TestProjectLocator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{
+		"projects/build.git",
+		"projects/build.git/subprojects/soong.git",
+		"project-objects/platform/art.git",
+		"platform/bionic.git",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+
+	l, err := NewProjectLocator(dir)
+	if err != nil {
+		t.Fatalf("NewProjectLocator: %v", err)
+	}
+	for _, p := range []manifest.Project{
+		{Path: "build", Name: "platform/build"},
+		{Path: "art", Name: "platform/art"},
+		{Path: "bionic", Name: "platform/bionic"},
+		{Path: "build/soong", Name: "platform/build/soong", Parent: &manifest.Project{Path: "build", Name: "platform/build"}},
+	} {
+		if _, err := l.Locate(&p); err != nil {
+			t.Errorf("Locate(%q): %v", p.Name, err)
+		}
+	}
+
+	l, err = NewProjectLocator(dir, "mirror")
+	if err != nil {
+		t.Fatalf("NewProjectLocator: %v", err)
+	}
+	_, err = l.Locate(&manifest.Project{Path: "build", Name: "platform/build"})
+	if lerr, ok := err.(*LocateError); !ok {
+		t.Errorf("got %v, want *LocateError", err)
+	} else if len(lerr.Tried) != 1 {
+		t.Errorf("got %v, want 1 candidate", lerr.Tried)
+	}
+
+	if _, err := NewProjectLocator(dir, "unknown"); err == nil {
+		t.Errorf("NewProjectLocator accepted unknown layout")
+	}
+}
+
+func TestManifestFSUpdate(t *testing.T) {
+	tc, root, err := setupManifest(testManifest, nil)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	// Have the kernel cache the status before the update.
+	if _, err := ioutil.ReadFile(filepath.Join(tc.mnt, StatusFile)); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	m, err := manifest.Parse([]byte(`<manifest>
+  <default revision="master" />
+  <project path="moved/build" name="platform/build">
+    <copyfile src="file" dest="Makefile.new" />
+  </project>
+</manifest>`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	// Not synchronized with the kernel closing files.
+	if err := retry(func() error { return root.Update(m) }); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	testGitFS(tc.mnt+"/moved/build", t)
+	for _, gone := range []string{"build", "Makefile", "sub/link"} {
+		if _, err := os.Lstat(filepath.Join(tc.mnt, gone)); err == nil {
+			t.Errorf("%q still exists", gone)
+		}
+	}
+	if content, err := ioutil.ReadFile(tc.mnt + "/Makefile.new"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(tc.mnt, StatusFile)); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if !strings.HasPrefix(string(content), "moved/build\tplatform/build:") {
+		t.Errorf("status after update: got %q", content)
+	}
+}
+
+func TestManifestFSRetarget(t *testing.T) {
+	tc, root, err := setupManifest(testManifest, nil)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	dir := filepath.Dir(tc.mnt)
+	nested, err := setupRepo(filepath.Join(dir, "projects", "build", "nested.git"))
+	if err != nil {
+		t.Fatalf("setupRepo: %v", err)
+	}
+	defer nested.Free()
+
+	parse := func(revision string) *manifest.Manifest {
+		m, err := manifest.Parse([]byte(`<manifest>
+  <default revision="master" />
+  <project path="build" name="platform/build" revision="` + revision + `">
+    <copyfile src="file" dest="Makefile" />
+    <linkfile src="dir/subfile" dest="sub/link" />
+  </project>
+  <project path="build/nested" name="platform/nested" />
+</manifest>`))
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		return m
+	}
+	if err := root.Update(parse("master")); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	odb, err := tc.repo.Odb()
+	if err != nil {
+		t.Fatalf("Odb: %v", err)
+	}
+	blobId, err := odb.Write([]byte("bye"), git.ObjectBlob)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	builder, err := tc.repo.TreeBuilder()
+	if err != nil {
+		t.Fatalf("TreeBuilder: %v", err)
+	}
+	defer builder.Free()
+	if err := builder.Insert("file", blobId, git.FilemodeBlob); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	treeId, err := builder.Write()
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	tree, err := tc.repo.LookupTree(treeId)
+	if err != nil {
+		t.Fatalf("LookupTree: %v", err)
+	}
+	sig := &git.Signature{"user", "user@invalid", time.Now()}
+	if _, err := tc.repo.CreateCommit("refs/heads/next", sig, sig, "next", tree); err != nil {
+		t.Fatalf("CreateCommit: %v", err)
+	}
+
+	// An open file keeps the nested project from being unmounted,
+	// so the update must leave it alone.
+	f, err := os.Open(tc.mnt + "/build/nested/file")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	if err := root.Update(parse("next")); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	for _, name := range []string{"build/file", "Makefile"} {
+		if content, err := ioutil.ReadFile(filepath.Join(tc.mnt, name)); err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		} else if string(content) != "bye" {
+			t.Errorf("%s: got %q, want %q", name, content, "bye")
+		}
+	}
+	if _, err := os.Lstat(tc.mnt + "/build/dir"); err == nil {
+		t.Errorf("build/dir still exists")
+	}
+	if content, err := ioutil.ReadAll(f); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	} else if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+	testGitFS(tc.mnt+"/build/nested", t)
+}
+
+func TestManifestFSUpdateBusy(t *testing.T) {
+	tc, root, err := setupManifest(testManifest, nil)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer tc.Cleanup()
+
+	f, err := os.Open(tc.mnt + "/build/file")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	m, err := manifest.Parse([]byte(`<manifest>
+  <default revision="master" />
+  <project path="moved/build" name="platform/build" />
+</manifest>`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := root.Update(m); err == nil {
+		t.Fatal("Update succeeded while a file of the project is open")
+	}
+
+	// The project stays where it was, and the status says so.
+	testGitFS(tc.mnt+"/build", t)
+	if mounts := root.Mounts(); len(mounts) != 1 || mounts[0].Path != "build" {
+		t.Errorf("got mounts %v, want build only", mounts)
+	}
+}
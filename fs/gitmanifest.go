@@ -0,0 +1,83 @@
+package fs
+
+import (
+	"fmt"
+	"time"
+
+	git "github.com/libgit2/git2go"
+
+	"github.com/hanwen/gitfs/manifest"
+)
+
+// ReadGitManifest reads the manifest file name, and the manifests it
+// includes, from the tree of treeish in a manifest repository. It
+// also returns the ID of the commit (or tree) that was read.
+func ReadGitManifest(repo *git.Repository, treeish, name string) (*manifest.Manifest, *git.Oid, error) {
+	treeId, commitId, err := resolveTree(repo, treeish)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tree, err := repo.LookupTree(treeId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tree.Free()
+
+	m, err := manifest.Load(name, func(n string) ([]byte, error) {
+		e, err := tree.EntryByPath(n)
+		if err != nil {
+			return nil, err
+		}
+		if e.Type != git.ObjectBlob {
+			return nil, fmt.Errorf("%s:%s is not a file", treeish, n)
+		}
+		blob, err := repo.LookupBlob(e.Id)
+		if err != nil {
+			return nil, err
+		}
+		defer blob.Free()
+		return append([]byte{}, blob.Contents()...), nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if commitId == nil {
+		commitId = treeId
+	}
+	return m, commitId, nil
+}
+
+// TrackGitManifest checks every interval whether treeish in the
+// manifest repository has moved away from last, and if so, updates
+// root to the manifest at the new commit. It does not return.
+func TrackGitManifest(root ManifestFS, repo *git.Repository, treeish, name string, last *git.Oid, interval time.Duration) {
+	log := logger().With("repo", repoDir(repo), "treeish", treeish, "manifest", name)
+	for range time.Tick(interval) {
+		treeId, commitId, err := resolveTree(repo, treeish)
+		if err != nil {
+			log.Errorf("resolving manifest: %v", err)
+			continue
+		}
+		if commitId == nil {
+			commitId = treeId
+		}
+		if commitId.Equal(last) {
+			continue
+		}
+
+		m, id, err := ReadGitManifest(repo, treeish, name)
+		if err != nil {
+			log.Errorf("reading manifest at %s: %v", commitId, err)
+			continue
+		}
+		log.Infof("manifest moved to %s", id)
+		if err := root.Update(m); err != nil {
+			// Try again at the next tick.
+			log.Errorf("updating manifest: %v", err)
+			continue
+		}
+		last = id
+	}
+}
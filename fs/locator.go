@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hanwen/gitfs/manifest"
+)
+
+// ProjectLocator finds the git repository for a manifest project.
+type ProjectLocator interface {
+	Locate(p *manifest.Project) (string, error)
+}
+
+// ProjectLayout describes where repositories are stored, relative to
+// a root directory. Path returns "" for projects the layout does not
+// apply to.
+type ProjectLayout struct {
+	Name string
+	Path func(p *manifest.Project) string
+}
+
+// ProjectLayouts lists the known layouts. For a repo checkout, the
+// root is the .repo directory.
+var ProjectLayouts = []ProjectLayout{
+	{"projects", func(p *manifest.Project) string {
+		return filepath.Join("projects", p.Path+".git")
+	}},
+	{"subprojects", func(p *manifest.Project) string {
+		if p.Parent == nil {
+			return ""
+		}
+		return subprojectGitdir(p)
+	}},
+	{"project-objects", func(p *manifest.Project) string {
+		return filepath.Join("project-objects", p.Name+".git")
+	}},
+	{"mirror", func(p *manifest.Project) string {
+		return p.Name + ".git"
+	}},
+}
+
+// subprojectGitdir returns where repo keeps the repository of a
+// project: under the projects directory, or in the subprojects
+// directory of its parent's repository for subprojects.
+func subprojectGitdir(p *manifest.Project) string {
+	if p.Parent == nil {
+		return filepath.Join("projects", p.Path+".git")
+	}
+	rel := strings.TrimPrefix(p.Path, p.Parent.Path+"/")
+	return filepath.Join(subprojectGitdir(p.Parent), "subprojects", rel+".git")
+}
+
+// LocateError is returned if none of the candidate repositories for a
+// project exist.
+type LocateError struct {
+	Project string
+	Tried   []string
+}
+
+func (e *LocateError) Error() string {
+	return fmt.Sprintf("no repository for project %q, tried %s", e.Project, strings.Join(e.Tried, ", "))
+}
+
+type layoutLocator struct {
+	root    string
+	layouts []ProjectLayout
+}
+
+// NewProjectLocator returns a locator that tries the named layouts
+// under root in order. Without names, all ProjectLayouts are tried.
+func NewProjectLocator(root string, names ...string) (ProjectLocator, error) {
+	l := &layoutLocator{root: root}
+	if len(names) == 0 {
+		l.layouts = ProjectLayouts
+	}
+	for _, n := range names {
+		found := false
+		for _, layout := range ProjectLayouts {
+			if layout.Name == n {
+				l.layouts = append(l.layouts, layout)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("gitfs: unknown project layout %q", n)
+		}
+	}
+	return l, nil
+}
+
+func (l *layoutLocator) Locate(p *manifest.Project) (string, error) {
+	var tried []string
+	for _, layout := range l.layouts {
+		rel := layout.Path(p)
+		if rel == "" {
+			continue
+		}
+		dir := filepath.Join(l.root, rel)
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir, nil
+		}
+		tried = append(tried, dir)
+	}
+	return "", &LocateError{p.Name, tried}
+}
@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARNING", "ERROR"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name, eg. "info", ignoring case.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// LoggerOptions configures NewLogger.
+type LoggerOptions struct {
+	// Level is the lowest level that is logged.
+	Level Level
+
+	// JSON makes each message a JSON object, instead of a line
+	// of text.
+	JSON bool
+
+	// DebugMounts, if set, limits debug messages to the trees
+	// mounted at paths matching one of these path.Match
+	// patterns, eg. "platform/build".
+	DebugMounts []string
+}
+
+type logOutput struct {
+	mu   sync.Mutex
+	w    io.Writer
+	opts LoggerOptions
+}
+
+// Logger writes leveled log messages with fields, such as the
+// repository and mount path.
+type Logger struct {
+	out *logOutput
+
+	// key, value pairs.
+	fields []string
+
+	// debug is whether debug messages pass the DebugMounts filter.
+	debug bool
+}
+
+// NewLogger returns a Logger writing to w.
+func NewLogger(w io.Writer, opts *LoggerOptions) *Logger {
+	if opts == nil {
+		opts = &LoggerOptions{Level: LevelInfo}
+	}
+	return &Logger{
+		out:   &logOutput{w: w, opts: *opts},
+		debug: len(opts.DebugMounts) == 0,
+	}
+}
+
+var (
+	defaultLoggerMu sync.Mutex
+	defaultLogger   = NewLogger(os.Stderr, nil)
+)
+
+// SetLogger sets the logger for the filesystems created afterwards,
+// and for messages that are not about a particular filesystem.
+func SetLogger(l *Logger) {
+	defaultLoggerMu.Lock()
+	defer defaultLoggerMu.Unlock()
+	defaultLogger = l
+}
+
+// logger returns the logger set with SetLogger.
+func logger() *Logger {
+	defaultLoggerMu.Lock()
+	defer defaultLoggerMu.Unlock()
+	return defaultLogger
+}
+
+// With returns a Logger that adds the given key, value pairs to
+// each message, replacing earlier values for the same keys. The
+// "mount" key selects debug messages for LoggerOptions.DebugMounts.
+func (l *Logger) With(kv ...string) *Logger {
+	w := &Logger{
+		out:    l.out,
+		fields: append([]string{}, l.fields...),
+		debug:  l.debug,
+	}
+next:
+	for i := 0; i+1 < len(kv); i += 2 {
+		for j := 0; j+1 < len(w.fields); j += 2 {
+			if w.fields[j] == kv[i] {
+				w.fields[j+1] = kv[i+1]
+				continue next
+			}
+		}
+		w.fields = append(w.fields, kv[i], kv[i+1])
+	}
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i] != "mount" {
+			continue
+		}
+		w.debug = false
+		for _, pattern := range l.out.opts.DebugMounts {
+			if ok, _ := path.Match(pattern, kv[i+1]); ok {
+				w.debug = true
+			}
+		}
+	}
+	return w
+}
+
+// DebugEnabled returns whether debug messages are logged, so callers
+// can skip preparing them.
+func (l *Logger) DebugEnabled() bool {
+	return l.debug && l.out.opts.Level <= LevelDebug
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	if l.DebugEnabled() {
+		l.log(LevelDebug, format, args...)
+	}
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.log(LevelWarning, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if level < l.out.opts.Level {
+		return
+	}
+	now := time.Now()
+	msg := fmt.Sprintf(format, args...)
+
+	var buf bytes.Buffer
+	if l.out.opts.JSON {
+		m := map[string]string{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": level.String(),
+			"msg":   msg,
+		}
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			m[l.fields[i]] = l.fields[i+1]
+		}
+		b, _ := json.Marshal(m)
+		buf.Write(b)
+	} else {
+		fmt.Fprintf(&buf, "%s %s %s", now.Format("2006/01/02 15:04:05"), level, msg)
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			v := l.fields[i+1]
+			if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+				v = strconv.Quote(v)
+			}
+			fmt.Fprintf(&buf, " %s=%s", l.fields[i], v)
+		}
+	}
+	buf.WriteByte('\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
@@ -1,88 +1,387 @@
 package fs
 
 import (
-	"log"
-	"sync"
+	"fmt"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 
 	git "github.com/libgit2/git2go"
+
 	"github.com/hanwen/gitfs/manifest"
+	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 )
 
 type manifestFSRoot struct {
 	nodefs.Node
 
+	opts    ManifestFSOptions
+	gitOpts *GitFSOptions
+	fsConn  *nodefs.FileSystemConnector
+
+	// update serializes Update and OnMount, which change the
+	// mounts. They hold mu only to read and swap the fields below.
+	update sync.Mutex
+
+	// mu protects the fields below, which change on Update. They
+	// describe what is mounted.
+	mu       sync.Mutex
 	manifest manifest.Manifest
-	fsConn   *nodefs.FileSystemConnector
 	// keyed by name (from the manifest)
 	repoMap map[string]nodefs.Node
+
+	// copyfile and linkfile nodes, keyed by destination path.
+	files map[string]*manifestFile
+
+	// pinned and statusFile are the files that describe what is
+	// mounted, refreshed on Update.
+	pinned     *generatedFileNode
+	statusFile *generatedFileNode
+
+	log *Logger
+}
+
+// ManifestFSOptions configures NewManifestFS.
+type ManifestFSOptions struct {
+	// Groups selects the projects to mount; see
+	// manifest.ParseGroups. If nil, the default group is used.
+	Groups []string
+
+	// Strict makes NewManifestFS fail if any project cannot be
+	// loaded. Otherwise, such projects show up as empty
+	// directories containing an error file.
+	Strict bool
+
+	// Locator finds the repositories for the projects. If nil,
+	// all ProjectLayouts are tried under the repository root.
+	Locator ProjectLocator
 }
 
-func NewManifestFS(m *manifest.Manifest, repoRoot string, gitOpts *GitFSOptions) (nodefs.Node, error) {
-	filtered := *m
+// ManifestFS is the root of a filesystem created by NewManifestFS.
+type ManifestFS interface {
+	nodefs.Node
+
+	// Update switches the filesystem to a new version of the
+	// manifest. Projects whose path and revision did not change
+	// are left alone, and projects whose revision changed are
+	// switched to the new tree in place. Projects that cannot be unmounted, for
+	// example because they have open files, stay as they were,
+	// and the errors are returned.
+	Update(m *manifest.Manifest) error
+
+	// Mounts lists the mounted projects.
+	Mounts() []MountStatus
+}
+
+// ErrorFileName is the file describing why a project or file could
+// not be loaded, if ManifestFSOptions.Strict is not set.
+const ErrorFileName = ".gitfs-error"
+
+// NewManifestFS creates a FS for the projects of a manifest, whose
+// repositories live under repoRoot, typically a .repo directory.
+func NewManifestFS(m *manifest.Manifest, repoRoot string, opts *ManifestFSOptions, gitOpts *GitFSOptions) (ManifestFS, error) {
+	root := &manifestFSRoot{
+		Node:    nodefs.NewDefaultNode(),
+		gitOpts: gitOpts,
+		repoMap: map[string]nodefs.Node{},
+		files:   map[string]*manifestFile{},
+		log:     logger().With("manifest", repoRoot),
+	}
+	if opts != nil {
+		root.opts = *opts
+	}
+	if root.opts.Groups == nil {
+		root.opts.Groups = manifest.ParseGroups("")
+	}
+	if root.opts.Locator == nil {
+		var err error
+		root.opts.Locator, err = NewProjectLocator(repoRoot)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filtered, err := root.filter(m)
+	if err != nil {
+		return nil, err
+	}
+
+	repoMap, failed := root.loadProjects(filtered, filtered.Project)
+	files, fileErrs := newFileNodes(filtered, repoMap, nil)
+	if err := root.check(filtered.Project, failed, fileErrs); err != nil {
+		return nil, err
+	}
+
+	root.manifest = *filtered
+	root.repoMap = repoMap
+	root.files = files
+	return root, nil
+}
+
+// filter returns the effective manifest for m, with the projects
+// that are selected by the groups option, after validating them.
+func (r *manifestFSRoot) filter(m *manifest.Manifest) (*manifest.Manifest, error) {
+	effective := m.Effective()
+	filtered := *effective
 	filtered.Project = nil
-	for _, p := range m.Project {
-		if p.Groups["notdefault"] {
+	for _, p := range effective.Project {
+		if !p.MatchGroups(r.opts.Groups) {
 			continue
 		}
 		filtered.Project = append(filtered.Project, p)
 	}
-		
-	root := &manifestFSRoot{
-		Node:     nodefs.NewDefaultNode(),
-		repoMap:  map[string]nodefs.Node{},
-		manifest: filtered,
+	if err := manifest.Validate(&filtered); err != nil {
+		return nil, err
 	}
+	return &filtered, nil
+}
 
+// loadProjects creates the root nodes for the given projects of m,
+// keyed by name. Projects that fail to load get a brokenProjectNode,
+// and their error is returned in failed.
+func (r *manifestFSRoot) loadProjects(m *manifest.Manifest, projects []manifest.Project) (nodes map[string]nodefs.Node, failed map[string]error) {
 	type result struct {
 		name string
 		node nodefs.Node
-		err error
+		err  error
 	}
 
-	ch := make(chan result, len(root.manifest.Project))
-	for _, p := range root.manifest.Project {
-		go func (p manifest.Project) {
-			// the spec isn't clear about this, but the git repo
-			// is placed locally at p.Path rather than p.Name
-			repo, err := git.OpenRepository(filepath.Join(repoRoot, p.Path) + ".git")
+	ch := make(chan result, len(projects))
+	for _, p := range projects {
+		go func(p manifest.Project) {
+			dir, err := r.opts.Locator.Locate(&p)
 			if err != nil {
-				ch <- result{err: err}
+				ch <- result{p.Name, nil, err}
 				return
 			}
-
-			remote := p.Remote
-			revision := p.Revision
-			if revision == "" {
-				revision = root.manifest.Default.Revision
-			}
-			if remote == "" {
-				remote = root.manifest.Remote.Name
+			repo, err := git.OpenRepository(dir)
+			if err != nil {
+				ch <- result{p.Name, nil, err}
+				return
 			}
 
-			commit := filepath.Join(remote, revision)
-			projectRoot, err := NewTreeFSRoot(repo, commit, gitOpts)
+			projectRoot, err := NewTreeFSRoot(repo, ProjectTreeish(m, &p), r.gitOpts)
 			ch <- result{p.Name, projectRoot, err}
 		}(p)
 	}
 
-	var firstError error
-	for _ = range root.manifest.Project {
+	nodes = map[string]nodefs.Node{}
+	failed = map[string]error{}
+	for _ = range projects {
 		res := <-ch
-		if firstError != nil {
-			continue
-		}
 		if res.err != nil {
-			firstError = res.err
+			failed[res.name] = res.err
+			nodes[res.name] = newBrokenProjectNode(res.err)
 		} else {
-			root.repoMap[res.name]  = res.node
+			nodes[res.name] = res.node
 		}
 	}
-	if firstError != nil {
-		return nil, firstError
+	return nodes, failed
+}
+
+// check returns an error for the failed projects, out of the ones
+// that were loaded, and files in strict mode, and logs them
+// otherwise.
+func (r *manifestFSRoot) check(projects []manifest.Project, failed map[string]error, fileErrs []error) error {
+	var errs []error
+	for _, p := range projects {
+		if err := failed[p.Name]; err != nil {
+			errs = append(errs, &manifest.ProjectError{Name: p.Name, Path: p.Path, Err: err})
+		}
 	}
-	return root, nil
+	errs = append(errs, fileErrs...)
+	if r.opts.Strict && len(errs) > 0 {
+		return &manifest.ValidationError{Errors: errs}
+	}
+
+	r.log.Infof("loaded %d of %d projects", len(projects)-len(failed), len(projects))
+	for _, err := range errs {
+		r.log.Warningf("%v", err)
+	}
+	return nil
+}
+
+// fileSpec describes a copyfile or linkfile entry.
+type fileSpec struct {
+	project string
+	src     string
+	link    bool
+}
+
+// manifestFile is the node for a copyfile or linkfile entry.
+type manifestFile struct {
+	spec fileSpec
+	node nodefs.Node
+}
+
+// fileSpecs returns the copyfile and linkfile entries of the
+// manifest, keyed by destination path.
+func fileSpecs(m *manifest.Manifest) map[string]fileSpec {
+	specs := map[string]fileSpec{}
+	for _, p := range m.Project {
+		for _, c := range p.Copyfile {
+			specs[filepath.Clean(c.Dest)] = fileSpec{p.Name, c.Src, false}
+		}
+		for _, l := range p.Linkfile {
+			specs[filepath.Clean(l.Dest)] = fileSpec{p.Name, l.Src, true}
+		}
+	}
+	return specs
+}
+
+// newFileNodes creates the nodes for the copyfile and linkfile
+// entries of the manifest, reusing the ones in keep that were made
+// for the same entry. Copyfiles are served read-only from the blob
+// in the source project; linkfiles become relative symlinks into
+// the project. Copyfiles that cannot be loaded are replaced by an
+// error file.
+func newFileNodes(m *manifest.Manifest, repoMap map[string]nodefs.Node, keep map[string]*manifestFile) (map[string]*manifestFile, []error) {
+	files := map[string]*manifestFile{}
+	var errs []error
+	for _, p := range m.Project {
+		for _, c := range p.Copyfile {
+			dest := filepath.Clean(c.Dest)
+			spec := fileSpec{p.Name, c.Src, false}
+			if f := keep[dest]; f != nil && f.spec == spec {
+				files[dest] = f
+				continue
+			}
+			n, err := newCopyfileNode(repoMap[p.Name], c.Src)
+			if err != nil {
+				err = fmt.Errorf("copyfile %q of project %q: %v", c.Src, p.Name, err)
+				errs = append(errs, err)
+				n = newErrorNode(err)
+			}
+			files[dest] = &manifestFile{spec, n}
+		}
+		for _, l := range p.Linkfile {
+			dest := filepath.Clean(l.Dest)
+			spec := fileSpec{p.Name, l.Src, true}
+			if f := keep[dest]; f != nil && f.spec == spec {
+				files[dest] = f
+				continue
+			}
+			target, err := filepath.Rel(filepath.Dir(dest), filepath.Join(p.Path, l.Src))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("linkfile %q of project %q: %v", l.Src, p.Name, err))
+				continue
+			}
+			files[dest] = &manifestFile{spec, newLinkfileNode(target)}
+		}
+	}
+	return files, errs
+}
+
+func newCopyfileNode(projectRoot nodefs.Node, src string) (nodefs.Node, error) {
+	root, ok := projectRoot.(*dirNode)
+	if !ok {
+		return nil, fmt.Errorf("project not loaded")
+	}
+
+	id, _ := root.target()
+	tree, err := root.fs.repo.LookupTree(id)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	e, err := tree.EntryByPath(src)
+	if err != nil {
+		return nil, err
+	}
+	if e.Filemode&^07777 != syscall.S_IFREG {
+		return nil, fmt.Errorf("%q is not a regular file", src)
+	}
+	return root.fs.newBlobNode(e.Id.Copy(), e.Filemode, src)
+}
+
+// SHA1RE matches a full hexadecimal object ID.
+var SHA1RE = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// ProjectTreeish returns the treeish to mount for the project of m.
+// Branch names refer to the remote tracking branch; SHA1s and full
+// refs are used as is.
+func ProjectTreeish(m *manifest.Manifest, p *manifest.Project) string {
+	remote := m.ProjectRemote(p)
+	revision := m.ProjectRevision(p)
+	if SHA1RE.MatchString(revision) {
+		return revision
+	}
+	if strings.HasPrefix(revision, "refs/heads/") {
+		revision = strings.TrimPrefix(revision, "refs/heads/")
+	} else if strings.HasPrefix(revision, "refs/") {
+		return revision
+	}
+	return filepath.Join(remote, revision)
+}
+
+// PinnedManifestPath is the file in a manifest FS that holds a
+// manifest with every project pinned to the commit that is mounted.
+// Projects that failed to load keep their revision, and have a
+// LoadErrorAnnotation.
+const PinnedManifestPath = ".gitfs/pinned-manifest.xml"
+
+// LoadErrorAnnotation is the annotation of the projects in the
+// pinned manifest that could not be loaded, with the error as value.
+const LoadErrorAnnotation = "gitfs-load-error"
+
+// pinnedManifest returns the mounted manifest, with revisions
+// replaced by the commits that were mounted. The original revision
+// is kept as upstream. Subprojects are nested in their parent again,
+// with their own name and path.
+func (r *manifestFSRoot) pinnedManifest() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Subprojects whose parent is not mounted stay at the top,
+	// as they were mounted.
+	mounted := map[string]bool{}
+	for _, p := range r.manifest.Project {
+		mounted[p.Path] = true
+	}
+	var top []int
+	children := map[string][]int{}
+	for i, p := range r.manifest.Project {
+		if p.Parent != nil && mounted[p.Parent.Path] {
+			children[p.Parent.Path] = append(children[p.Parent.Path], i)
+		} else {
+			top = append(top, i)
+		}
+	}
+
+	var pin func(i int, parent *manifest.Project) manifest.Project
+	pin = func(i int, parent *manifest.Project) manifest.Project {
+		p := r.manifest.Project[i]
+		if b, ok := r.repoMap[p.Name].(*brokenProjectNode); ok {
+			p.Annotation = append(append([]manifest.Annotation{}, p.Annotation...),
+				manifest.Annotation{Name: LoadErrorAnnotation, Value: b.err.Error()})
+		} else if commit := rootCommit(r.repoMap[p.Name]); commit != "" {
+			if p.Upstream == "" {
+				p.Upstream = r.manifest.ProjectRevision(&p)
+			}
+			p.Revision = commit
+		}
+		for _, j := range children[p.Path] {
+			p.Project = append(p.Project, pin(j, &r.manifest.Project[i]))
+		}
+		if parent != nil {
+			p.Name = strings.TrimPrefix(p.Name, parent.Name+"/")
+			p.Path = strings.TrimPrefix(p.Path, parent.Path+"/")
+		}
+		p.Parent = nil
+		return p
+	}
+
+	pinned := r.manifest
+	pinned.Project = nil
+	for _, i := range top {
+		pinned.Project = append(pinned.Project, pin(i, nil))
+	}
+	return pinned.Marshal()
 }
 
 func parents(path string) []string {
@@ -97,26 +396,74 @@ func parents(path string) []string {
 	return r
 }
 
-
 func (r *manifestFSRoot) OnMount(fsConn *nodefs.FileSystemConnector) {
+	r.update.Lock()
+	defer r.update.Unlock()
+
+	r.mu.Lock()
 	r.fsConn = fsConn
+	projects, repoMap, files := r.manifest.Project, r.repoMap, r.files
+	r.mu.Unlock()
 
-	todo := map[string]manifest.Project{}
-	for _, project := range r.manifest.Project {
-		if project.Groups["notdefault"] {
-			continue
+	for _, err := range r.mountProjects(projects, repoMap) {
+		r.log.Errorf("%v", err)
+	}
+	for dest, f := range files {
+		if err := r.addFile(dest, f.node); err != nil {
+			r.log.Warningf("%v", err)
 		}
+	}
+	r.pinned = newGeneratedFileNode(r.pinnedManifest, false)
+	r.statusFile = newGeneratedFileNode(r.status, false)
+	r.addFile(PinnedManifestPath, r.pinned)
+	r.addFile(StatusFile, r.statusFile)
+	if r.gitOpts != nil && r.gitOpts.Metrics != nil {
+		r.addFile(StatsFile, newGeneratedFileNode(r.gitOpts.Metrics.JSON, true))
+	}
+}
 
+// Mounts lists the mounted projects.
+func (r *manifestFSRoot) Mounts() []MountStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var mounts []MountStatus
+	for _, p := range r.manifest.Project {
+		commit := rootCommit(r.repoMap[p.Name])
+		if _, ok := r.repoMap[p.Name].(*brokenProjectNode); ok {
+			commit = "error"
+		}
+		mounts = append(mounts, MountStatus{
+			Path:   p.Path,
+			Source: p.Name + ":" + ProjectTreeish(&r.manifest, &p),
+			Commit: commit,
+		})
+	}
+	return mounts
+}
+
+func (r *manifestFSRoot) status() ([]byte, error) {
+	return formatStatus(r.Mounts()), nil
+}
+
+// mountProjects mounts the given projects, parents before the
+// projects nested inside them. It returns the errors of the projects
+// that could not be mounted, keyed by name.
+func (r *manifestFSRoot) mountProjects(projects []manifest.Project, repoMap map[string]nodefs.Node) map[string]error {
+	todo := map[string]manifest.Project{}
+	for _, project := range projects {
 		todo[project.Path] = project
 	}
-	
+
+	var mu sync.Mutex
+	errs := map[string]error{}
 	for len(todo) > 0 {
 		next := map[string]manifest.Project{}
 		var wg sync.WaitGroup
 		for _, t := range todo {
 			foundParent := false
 			for _, p := range parents(t.Path) {
-				if _, ok := todo[p] ; ok {
+				if _, ok := todo[p]; ok {
 					foundParent = true
 					break
 				}
@@ -125,8 +472,12 @@ func (r *manifestFSRoot) OnMount(fsConn *nodefs.FileSystemConnector) {
 			if !foundParent {
 				wg.Add(1)
 				go func(p manifest.Project) {
-					r.addRepo(&p)
-					wg.Done()
+					defer wg.Done()
+					if err := r.addRepo(&p, repoMap[p.Name]); err != nil {
+						mu.Lock()
+						errs[p.Name] = err
+						mu.Unlock()
+					}
 				}(t)
 			} else {
 				next[t.Path] = t
@@ -135,26 +486,484 @@ func (r *manifestFSRoot) OnMount(fsConn *nodefs.FileSystemConnector) {
 		wg.Wait()
 		todo = next
 	}
+	return errs
 }
 
-func (r *manifestFSRoot) addRepo(project *manifest.Project) {
-	node, components := r.fsConn.Node(r.Inode(), project.Path)
+func (r *manifestFSRoot) addFile(dest string, n nodefs.Node) error {
+	node, components := r.fsConn.Node(r.Inode(), dest)
 	if len(components) == 0 {
-		log.Fatalf("huh %v", *project)
+		return fmt.Errorf("file %q already exists", dest)
 	}
 	last := len(components) - 1
 	for _, c := range components[:last] {
 		node = node.NewChild(c, true, nodefs.NewDefaultNode())
 	}
+	node.NewChild(components[last], false, n)
+	return nil
+}
+
+// lookupParent returns the directory containing path, and the last
+// component of path.
+func (r *manifestFSRoot) lookupParent(path string) (*nodefs.Inode, string) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		return r.Inode(), base
+	}
+	return r.fsConn.LookupNode(r.Inode(), filepath.Clean(dir)), base
+}
+
+// removeFile removes the file n added at dest, if it is there.
+func (r *manifestFSRoot) removeFile(dest string, n nodefs.Node) {
+	parent, name := r.lookupParent(dest)
+	if parent == nil {
+		return
+	}
+	if ch := parent.GetChild(name); ch != nil && ch.Node() == n {
+		parent.RmChild(name)
+	}
+}
+
+func (r *manifestFSRoot) removeRepo(project *manifest.Project) error {
+	parent, name := r.lookupParent(project.Path)
+	if parent == nil {
+		return nil
+	}
+	node := parent.GetChild(name)
+	if node == nil {
+		return nil
+	}
+	if code := r.fsConn.Unmount(node); !code.Ok() {
+		return &manifest.ProjectError{Name: project.Name, Path: project.Path, Err: fmt.Errorf("unmount: %v", code)}
+	}
+	return nil
+}
+
+// notify makes the kernel forget about path and the directories
+// leading up to it.
+func (r *manifestFSRoot) notify(path string) {
+	for _, p := range append([]string{path}, parents(path)...) {
+		if parent, name := r.lookupParent(p); parent != nil {
+			r.fsConn.EntryNotify(parent, name)
+		}
+	}
+}
+
+// nestedIn returns whether path is dir or inside it.
+func nestedIn(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+func (r *manifestFSRoot) Update(m *manifest.Manifest) error {
+	filtered, err := r.filter(m)
+	if err != nil {
+		return err
+	}
+
+	// Projects are loaded, and mounts changed, without holding mu,
+	// so the files describing the mount stay readable meanwhile.
+	r.update.Lock()
+	defer r.update.Unlock()
+
+	r.mu.Lock()
+	cur := r.manifest
+	repoMap := map[string]nodefs.Node{}
+	for name, n := range r.repoMap {
+		repoMap[name] = n
+	}
+	oldFiles := r.files
+	r.mu.Unlock()
+
+	old := map[string]manifest.Project{}
+	for _, p := range cur.Project {
+		old[p.Name] = p
+	}
+	current := map[string]bool{}
+	for _, p := range filtered.Project {
+		current[p.Name] = true
+	}
+
+	var changed []manifest.Project
+	isChanged := map[string]bool{}
+	for _, p := range filtered.Project {
+		o, ok := old[p.Name]
+		_, broken := repoMap[p.Name].(*brokenProjectNode)
+		if ok && !broken && o.Path == p.Path &&
+			ProjectTreeish(&cur, &o) == ProjectTreeish(filtered, &p) {
+			continue
+		}
+		changed = append(changed, p)
+		isChanged[p.Name] = true
+	}
+
+	nodes, failed := r.loadProjects(filtered, changed)
+	if err := r.check(changed, failed, nil); err != nil {
+		return err
+	}
+
+	// Projects that stay at their path are retargeted in place,
+	// keeping the projects and files nested inside them. The old
+	// paths of the other changed projects, and of dropped ones,
+	// are unmounted, and the projects nested inside them are
+	// mounted again.
+	retargets := map[string]bool{}
+	var gone []string
+	for _, p := range changed {
+		o, ok := old[p.Name]
+		if !ok {
+			continue
+		}
+		if r.fsConn != nil && o.Path == p.Path && canRetarget(repoMap[p.Name], nodes[p.Name]) {
+			retargets[p.Name] = true
+			continue
+		}
+		gone = append(gone, o.Path)
+	}
+	dropped := 0
+	for _, o := range cur.Project {
+		if !current[o.Name] {
+			gone = append(gone, o.Path)
+			dropped++
+		}
+	}
+	isGone := func(path string) bool {
+		for _, d := range gone {
+			if nestedIn(path, d) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Files whose entry and project did not change are kept, as
+	// are linkfiles into projects that did not move.
+	newPaths := map[string]string{}
+	for _, p := range filtered.Project {
+		newPaths[p.Name] = p.Path
+	}
+	specs := fileSpecs(filtered)
+	keepFiles := map[string]*manifestFile{}
+	for dest, f := range oldFiles {
+		spec, ok := specs[dest]
+		if ok && spec == f.spec && (!isChanged[spec.project] ||
+			spec.link && old[spec.project].Path == newPaths[spec.project]) {
+			keepFiles[dest] = f
+		} else if r.fsConn != nil {
+			r.removeFile(dest, f.node)
+			r.notify(dest)
+		}
+	}
+
+	var errs []error
+
+	// stuck has the old projects that could not be unmounted, and
+	// so stay as they are.
+	stuck := map[string]bool{}
+	unmounted := map[string]bool{}
+	if r.fsConn != nil {
+		var removed []manifest.Project
+		for _, o := range cur.Project {
+			if isGone(o.Path) {
+				removed = append(removed, o)
+			}
+		}
+		// Unmount nested projects first.
+		sort.Slice(removed, func(i, j int) bool {
+			return len(removed[i].Path) > len(removed[j].Path)
+		})
+		for _, o := range removed {
+			if err := r.removeRepo(&o); err != nil {
+				if !retargets[o.Name] {
+					errs = append(errs, err)
+					stuck[o.Name] = true
+				}
+				continue
+			}
+			unmounted[o.Name] = true
+			r.notify(o.Path)
+		}
+		// Files inside unmounted projects went with them.
+		for _, o := range removed {
+			for dest := range keepFiles {
+				if unmounted[o.Name] && nestedIn(dest, o.Path) {
+					delete(keepFiles, dest)
+				}
+			}
+		}
+
+		for _, p := range filtered.Project {
+			if !retargets[p.Name] || unmounted[p.Name] {
+				continue
+			}
+			var keep []string
+			for _, o := range cur.Project {
+				if o.Name != p.Name && !unmounted[o.Name] && nestedIn(o.Path, p.Path) {
+					keep = append(keep, strings.TrimPrefix(o.Path, p.Path+"/"))
+				}
+			}
+			for dest := range keepFiles {
+				if nestedIn(dest, p.Path) {
+					keep = append(keep, strings.TrimPrefix(dest, p.Path+"/"))
+				}
+			}
+			if err := retarget(r.fsConn, repoMap[p.Name].(*dirNode), nodes[p.Name].(*dirNode), keep); err != nil {
+				errs = append(errs, &manifest.ProjectError{Name: p.Name, Path: p.Path, Err: err})
+			}
+		}
+	}
+
+	// next has the projects as they are mounted after the update.
+	next := *filtered
+	next.Project = nil
+	var mount []manifest.Project
+	for _, p := range filtered.Project {
+		if stuck[p.Name] {
+			next.Project = append(next.Project, old[p.Name])
+			continue
+		}
+		next.Project = append(next.Project, p)
+		if retargets[p.Name] && !unmounted[p.Name] {
+			// The mounted root now serves the new tree.
+			continue
+		}
+		if n, ok := nodes[p.Name]; ok {
+			repoMap[p.Name] = n
+		}
+		if isChanged[p.Name] || unmounted[p.Name] {
+			mount = append(mount, p)
+		}
+	}
+	for _, o := range cur.Project {
+		if current[o.Name] {
+			continue
+		}
+		if stuck[o.Name] {
+			next.Project = append(next.Project, o)
+		} else {
+			delete(repoMap, o.Name)
+		}
+	}
+
+	if r.fsConn != nil {
+		mountErrs := r.mountProjects(mount, repoMap)
+		mounted := next.Project[:0]
+		for _, p := range next.Project {
+			if err := mountErrs[p.Name]; err != nil {
+				errs = append(errs, err)
+				delete(repoMap, p.Name)
+				continue
+			}
+			mounted = append(mounted, p)
+		}
+		next.Project = mounted
+		for _, p := range mount {
+			r.notify(p.Path)
+		}
+	}
+
+	files, fileErrs := newFileNodes(&next, repoMap, keepFiles)
+	for _, err := range fileErrs {
+		r.log.Warningf("%v", err)
+	}
+	if r.opts.Strict {
+		errs = append(errs, fileErrs...)
+	}
+	if r.fsConn != nil {
+		for dest, f := range files {
+			if keepFiles[dest] == f {
+				continue
+			}
+			if err := r.addFile(dest, f.node); err != nil {
+				errs = append(errs, err)
+				delete(files, dest)
+				continue
+			}
+			r.notify(dest)
+		}
+	}
+
+	r.mu.Lock()
+	r.manifest = next
+	r.repoMap = repoMap
+	r.files = files
+	r.mu.Unlock()
+	r.pinned.refresh(r.fsConn)
+	r.statusFile.refresh(r.fsConn)
 
-	rootNode := r.repoMap[project.Name]
+	r.log.Infof("manifest updated: %d projects added or changed, %d removed",
+		len(changed), dropped)
+	if len(errs) > 0 {
+		return &manifest.ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+func (r *manifestFSRoot) addRepo(project *manifest.Project, rootNode nodefs.Node) error {
 	if rootNode == nil {
-		panic(project.Name)
+		return &manifest.ProjectError{Name: project.Name, Path: project.Path, Err: fmt.Errorf("project was not loaded")}
+	}
+	node, components := r.fsConn.Node(r.Inode(), project.Path)
+	if len(components) == 0 {
+		return &manifest.ProjectError{Name: project.Name, Path: project.Path, Err: fmt.Errorf("project path already exists")}
 	}
-	if code := r.fsConn.Mount(node, components[last], rootNode, nil); !code.Ok() {
-		// TODO - this cannot happen if the manifest
-		// is well formed, but should check that in a
-		// place where we can return error.
-		log.Printf("Mount: %v - %v", project, code)
+	last := len(components) - 1
+	for _, c := range components[:last] {
+		node = node.NewChild(c, true, nodefs.NewDefaultNode())
 	}
+
+	setMountPath(rootNode, project.Path)
+	if code := r.fsConn.Mount(node, components[last], rootNode, r.gitOpts.NodefsOptions()); !code.Ok() {
+		return &manifest.ProjectError{Name: project.Name, Path: project.Path, Err: fmt.Errorf("mount: %v", code)}
+	}
+	return nil
+}
+
+// linkfileNode is the symlink of a linkfile. Unlike the symlinks
+// created in a tree, it cannot be removed.
+type linkfileNode struct {
+	nodefs.Node
+	target []byte
+}
+
+func newLinkfileNode(target string) *linkfileNode {
+	return &linkfileNode{
+		Node:   nodefs.NewDefaultNode(),
+		target: []byte(target),
+	}
+}
+
+func (n *linkfileNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (code fuse.Status) {
+	out.Mode = fuse.S_IFLNK | 0777
+	out.Size = uint64(len(n.target))
+	return fuse.OK
+}
+
+func (n *linkfileNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	return n.target, fuse.OK
+}
+
+// errorNode is a read-only file holding an error message.
+type errorNode struct {
+	nodefs.Node
+	content []byte
+}
+
+func newErrorNode(err error) *errorNode {
+	return &errorNode{
+		Node:    nodefs.NewDefaultNode(),
+		content: []byte(err.Error() + "\n"),
+	}
+}
+
+func (n *errorNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (code fuse.Status) {
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(n.content))
+	return fuse.OK
+}
+
+func (n *errorNode) Open(flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	return nodefs.NewDataFile(n.content), fuse.OK
+}
+
+// generatedFileNode is a read-only file whose content is computed.
+// The content is kept until refresh, so that it matches the size the
+// kernel caches. Volatile files are generated again on each open
+// instead, and read with direct I/O, which ignores the cached size.
+type generatedFileNode struct {
+	nodefs.Node
+	generate func() ([]byte, error)
+	volatile bool
+
+	mu      sync.Mutex
+	valid   bool
+	content []byte
+}
+
+func newGeneratedFileNode(generate func() ([]byte, error), volatile bool) *generatedFileNode {
+	return &generatedFileNode{
+		Node:     nodefs.NewDefaultNode(),
+		generate: generate,
+		volatile: volatile,
+	}
+}
+
+// get returns the content, generating it if needed.
+func (n *generatedFileNode) get() ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.valid && !n.volatile {
+		return n.content, nil
+	}
+	content, err := n.generate()
+	if err != nil {
+		return nil, err
+	}
+	n.content, n.valid = content, true
+	return content, nil
+}
+
+// refresh makes the file generate its content again when it is next
+// accessed, and drops what the kernel cached of it. It does nothing
+// on a nil node, which is not mounted yet.
+func (n *generatedFileNode) refresh(conn *nodefs.FileSystemConnector) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	valid := n.valid
+	n.valid = false
+	n.content = nil
+	n.mu.Unlock()
+	if valid && conn != nil && n.Inode() != nil {
+		conn.FileNotify(n.Inode(), 0, 0)
+	}
+}
+
+func (n *generatedFileNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (code fuse.Status) {
+	content, err := n.get()
+	if err != nil {
+		logger().Errorf("generating file: %v", err)
+		return fuse.EIO
+	}
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(content))
+	return fuse.OK
+}
+
+func (n *generatedFileNode) Open(flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.EPERM
+	}
+	content, err := n.get()
+	if err != nil {
+		logger().Errorf("generating file: %v", err)
+		return nil, fuse.EIO
+	}
+	if n.volatile {
+		return &nodefs.WithFlags{
+			File:      nodefs.NewDataFile(content),
+			FuseFlags: fuse.FOPEN_DIRECT_IO,
+		}, fuse.OK
+	}
+	return nodefs.NewDataFile(content), fuse.OK
+}
+
+// brokenProjectNode is the root of a project that could not be
+// loaded. It is an empty directory, except for an ErrorFileName file.
+type brokenProjectNode struct {
+	nodefs.Node
+	err error
+}
+
+func newBrokenProjectNode(err error) *brokenProjectNode {
+	return &brokenProjectNode{
+		Node: nodefs.NewDefaultNode(),
+		err:  err,
+	}
+}
+
+func (n *brokenProjectNode) OnMount(conn *nodefs.FileSystemConnector) {
+	n.Inode().NewChild(ErrorFileName, false, newErrorNode(n.err))
 }
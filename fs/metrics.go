@@ -0,0 +1,297 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The operations whose latency is measured.
+const (
+	opLookup = iota
+	opGetAttr
+	opOpen
+	opRead
+	opReadlink
+	numOps
+)
+
+var opNames = [numOps]string{"lookup", "getattr", "open", "read", "readlink"}
+
+// latencyBuckets are the upper bounds of the histogram buckets, in
+// seconds.
+var latencyBuckets = []float64{1e-5, 1e-4, 1e-3, 1e-2, 1e-1, 1, 10}
+
+type histogram struct {
+	count    int64
+	sumNanos int64
+	buckets  [8]int64 // len(latencyBuckets) + 1
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddInt64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.sumNanos, int64(d))
+	atomic.AddInt64(&h.count, 1)
+}
+
+// HistogramSnapshot is the state of a latency histogram.
+type HistogramSnapshot struct {
+	Count   int64
+	Seconds float64
+
+	// Buckets are the cumulative counts for the upper bounds in
+	// Le, in seconds; the last bucket is +Inf.
+	Le      []float64
+	Buckets []int64
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Count:   atomic.LoadInt64(&h.count),
+		Seconds: time.Duration(atomic.LoadInt64(&h.sumNanos)).Seconds(),
+		Le:      latencyBuckets,
+	}
+	var cum int64
+	for i := range h.buckets {
+		cum += atomic.LoadInt64(&h.buckets[i])
+		s.Buckets = append(s.Buckets, cum)
+	}
+	return s
+}
+
+// Metrics counts what the filesystem does. Set it in GitFSOptions
+// to collect metrics for all trees mounted with those options.
+type Metrics struct {
+	memoryLoads int64
+	diskLoads   int64
+	diskHits    int64
+	diskMisses  int64
+	readBytes   int64
+
+	objectHits   int64
+	objectMisses int64
+	prefetches   int64
+
+	ops [numOps]histogram
+	odb histogram
+
+	mu     sync.Mutex
+	gauges map[string]func() int64
+}
+
+// NewMetrics returns zeroed metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{gauges: map[string]func() int64{}}
+}
+
+// AddGauge registers a value that is computed when the metrics are
+// exported, such as the number of mounts.
+func (m *Metrics) AddGauge(name string, f func() int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = f
+}
+
+// The methods below may be called on a nil Metrics.
+
+// observe records the latency of an operation started at start.
+func (m *Metrics) observe(op int, start time.Time) {
+	if m != nil {
+		m.ops[op].observe(time.Since(start))
+	}
+}
+
+// observeODB records the latency of an object database lookup.
+func (m *Metrics) observeODB(start time.Time) {
+	if m != nil {
+		m.odb.observe(time.Since(start))
+	}
+}
+
+func (m *Metrics) add(counter *int64, n int64) {
+	if m != nil {
+		atomic.AddInt64(counter, n)
+	}
+}
+
+func (m *Metrics) blobLoad(disk bool) {
+	if m == nil {
+		return
+	}
+	if disk {
+		m.add(&m.diskLoads, 1)
+	} else {
+		m.add(&m.memoryLoads, 1)
+	}
+}
+
+func (m *Metrics) diskCache(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.add(&m.diskHits, 1)
+	} else {
+		m.add(&m.diskMisses, 1)
+	}
+}
+
+func (m *Metrics) objectCache(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.add(&m.objectHits, 1)
+	} else {
+		m.add(&m.objectMisses, 1)
+	}
+}
+
+func (m *Metrics) prefetched() {
+	if m != nil {
+		m.add(&m.prefetches, 1)
+	}
+}
+
+func (m *Metrics) served(n int) {
+	if m != nil {
+		m.add(&m.readBytes, int64(n))
+	}
+}
+
+// MetricsSnapshot is the state of Metrics at some point.
+type MetricsSnapshot struct {
+	// Ops has the latencies of FUSE operations, keyed by name,
+	// eg. "lookup", and ODB that of object database lookups.
+	Ops map[string]HistogramSnapshot
+	ODB HistogramSnapshot
+
+	MemoryBlobLoads int64
+	DiskBlobLoads   int64
+	DiskCacheHits   int64
+	DiskCacheMisses int64
+	ReadBytes       int64
+
+	// ObjectCacheHits and ObjectCacheMisses count lookups of
+	// blob sizes and small blobs in the in-memory object cache.
+	ObjectCacheHits   int64
+	ObjectCacheMisses int64
+
+	// PrefetchedBlobs counts the blobs loaded by prefetching.
+	PrefetchedBlobs int64
+
+	Gauges map[string]int64
+}
+
+// Snapshot returns the current values.
+func (m *Metrics) Snapshot() *MetricsSnapshot {
+	s := &MetricsSnapshot{
+		Ops:               map[string]HistogramSnapshot{},
+		ODB:               m.odb.snapshot(),
+		MemoryBlobLoads:   atomic.LoadInt64(&m.memoryLoads),
+		DiskBlobLoads:     atomic.LoadInt64(&m.diskLoads),
+		DiskCacheHits:     atomic.LoadInt64(&m.diskHits),
+		DiskCacheMisses:   atomic.LoadInt64(&m.diskMisses),
+		ReadBytes:         atomic.LoadInt64(&m.readBytes),
+		ObjectCacheHits:   atomic.LoadInt64(&m.objectHits),
+		ObjectCacheMisses: atomic.LoadInt64(&m.objectMisses),
+		PrefetchedBlobs:   atomic.LoadInt64(&m.prefetches),
+		Gauges:            map[string]int64{},
+	}
+	for i := range m.ops {
+		s.Ops[opNames[i]] = m.ops[i].snapshot()
+	}
+
+	m.mu.Lock()
+	gauges := make(map[string]func() int64, len(m.gauges))
+	for k, f := range m.gauges {
+		gauges[k] = f
+	}
+	m.mu.Unlock()
+	for k, f := range gauges {
+		s.Gauges[k] = f()
+	}
+	return s
+}
+
+// JSON returns a snapshot as indented JSON.
+func (m *Metrics) JSON() ([]byte, error) {
+	return m.Snapshot().JSON()
+}
+
+// JSON returns the snapshot as indented JSON.
+func (s *MetricsSnapshot) JSON() ([]byte, error) {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func writeHistogram(w io.Writer, name, labels string, h HistogramSnapshot) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, le := range h.Le {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, le, h.Buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.Buckets[len(h.Buckets)-1])
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.Seconds)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.Count)
+}
+
+// WritePrometheus writes the snapshot in the Prometheus text
+// exposition format.
+func (s *MetricsSnapshot) WritePrometheus(w io.Writer) {
+	fmt.Fprintf(w, "# HELP gitfs_op_duration_seconds Latency of FUSE operations.\n")
+	fmt.Fprintf(w, "# TYPE gitfs_op_duration_seconds histogram\n")
+	for _, op := range opNames {
+		writeHistogram(w, "gitfs_op_duration_seconds", fmt.Sprintf("op=%q", op), s.Ops[op])
+	}
+
+	fmt.Fprintf(w, "# HELP gitfs_odb_lookup_duration_seconds Latency of git object database lookups.\n")
+	fmt.Fprintf(w, "# TYPE gitfs_odb_lookup_duration_seconds histogram\n")
+	writeHistogram(w, "gitfs_odb_lookup_duration_seconds", "", s.ODB)
+
+	fmt.Fprintf(w, "# HELP gitfs_blob_loads_total Blobs loaded for reading.\n")
+	fmt.Fprintf(w, "# TYPE gitfs_blob_loads_total counter\n")
+	fmt.Fprintf(w, "gitfs_blob_loads_total{storage=\"memory\"} %d\n", s.MemoryBlobLoads)
+	fmt.Fprintf(w, "gitfs_blob_loads_total{storage=\"disk\"} %d\n", s.DiskBlobLoads)
+
+	fmt.Fprintf(w, "# HELP gitfs_disk_cache_lookups_total Lookups of blobs in the disk cache.\n")
+	fmt.Fprintf(w, "# TYPE gitfs_disk_cache_lookups_total counter\n")
+	fmt.Fprintf(w, "gitfs_disk_cache_lookups_total{result=\"hit\"} %d\n", s.DiskCacheHits)
+	fmt.Fprintf(w, "gitfs_disk_cache_lookups_total{result=\"miss\"} %d\n", s.DiskCacheMisses)
+
+	fmt.Fprintf(w, "# HELP gitfs_object_cache_lookups_total Lookups of blob sizes and small blobs in the object cache.\n")
+	fmt.Fprintf(w, "# TYPE gitfs_object_cache_lookups_total counter\n")
+	fmt.Fprintf(w, "gitfs_object_cache_lookups_total{result=\"hit\"} %d\n", s.ObjectCacheHits)
+	fmt.Fprintf(w, "gitfs_object_cache_lookups_total{result=\"miss\"} %d\n", s.ObjectCacheMisses)
+
+	fmt.Fprintf(w, "# HELP gitfs_prefetched_blobs_total Blobs loaded by prefetching.\n")
+	fmt.Fprintf(w, "# TYPE gitfs_prefetched_blobs_total counter\n")
+	fmt.Fprintf(w, "gitfs_prefetched_blobs_total %d\n", s.PrefetchedBlobs)
+
+	fmt.Fprintf(w, "# HELP gitfs_read_bytes_total Bytes served by reads.\n")
+	fmt.Fprintf(w, "# TYPE gitfs_read_bytes_total counter\n")
+	fmt.Fprintf(w, "gitfs_read_bytes_total %d\n", s.ReadBytes)
+
+	var names []string
+	for k := range s.Gauges {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(w, "# TYPE gitfs_%s gauge\n", k)
+		fmt.Fprintf(w, "gitfs_%s %d\n", k, s.Gauges[k])
+	}
+}
@@ -2,11 +2,12 @@ package fs
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
-	"time"
 
 	git "github.com/libgit2/git2go"
 
@@ -18,13 +19,52 @@ import (
 type multiGitFS struct {
 	fsConn *nodefs.FileSystemConnector
 	root   nodefs.Node
+	config *nodefs.Inode
 	opts   *GitFSOptions
+
+	// statusFile lists the mounts, and is refreshed when they
+	// change.
+	statusFile *generatedFileNode
+
+	// mu serializes changes to the config directory.
+	mu sync.Mutex
 }
 
-func NewMultiGitFSRoot(opts *GitFSOptions) nodefs.Node {
+// MultiGitFS is the root of a filesystem created by
+// NewMultiGitFSRoot. Its methods do the same as the corresponding
+// operations in the config directory. Paths are relative to the
+// root, and sources have the format of config symlinks,
+// REPO-DIR:TREEISH or DIR.
+type MultiGitFS interface {
+	nodefs.Node
+
+	// AddMount mounts source at path, creating parent
+	// directories as needed.
+	AddMount(path, source string) error
+
+	// RemoveMount unmounts the tree at path.
+	RemoveMount(path string) error
+
+	// Retarget replaces the tree mounted at path with source.
+	Retarget(path, source string) error
+
+	// Mounts lists the mounted trees.
+	Mounts() []MountStatus
+}
+
+// ConfigStatusFile is the file in the config directory that lists
+// the mounted repositories; see StatusFile.
+const ConfigStatusFile = ".status"
+
+// ConfigStatsFile is the file in the config directory with the
+// metrics as JSON, if GitFSOptions.Metrics is set.
+const ConfigStatsFile = ".stats"
+
+func NewMultiGitFSRoot(opts *GitFSOptions) MultiGitFS {
 	fs := &multiGitFS{opts: opts}
-	fs.root = &multiGitRoot{nodefs.NewDefaultNode(), fs}
-	return fs.root
+	root := &multiGitRoot{nodefs.NewDefaultNode(), fs}
+	fs.root = root
+	return root
 }
 
 type multiGitRoot struct {
@@ -34,7 +74,169 @@ type multiGitRoot struct {
 
 func (r *multiGitRoot) OnMount(fsConn *nodefs.FileSystemConnector) {
 	r.fs.fsConn = fsConn
-	r.Inode().NewChild("config", true, r.fs.newConfigNode(r))
+	r.fs.config = r.Inode().NewChild("config", true, r.fs.newConfigNode(r, ""))
+	r.fs.statusFile = newGeneratedFileNode(r.fs.status, false)
+	r.fs.config.NewChild(ConfigStatusFile, false, r.fs.statusFile)
+	if r.fs.opts != nil && r.fs.opts.Metrics != nil {
+		r.fs.config.NewChild(ConfigStatsFile, false, newGeneratedFileNode(r.fs.opts.Metrics.JSON, true))
+	}
+}
+
+func (r *multiGitRoot) AddMount(path, source string) error {
+	return r.fs.addMount(path, source)
+}
+
+func (r *multiGitRoot) RemoveMount(path string) error {
+	return r.fs.removeMount(path)
+}
+
+func (r *multiGitRoot) Retarget(path, source string) error {
+	return r.fs.retarget(path, source)
+}
+
+func (r *multiGitRoot) Mounts() []MountStatus {
+	return r.fs.mounts()
+}
+
+// mounts lists the repositories mounted through the config
+// directory.
+func (fs *multiGitFS) mounts() []MountStatus {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var mounts []MountStatus
+	var walk func(dir *nodefs.Inode, prefix string)
+	walk = func(dir *nodefs.Inode, prefix string) {
+		children := dir.Children()
+		var names []string
+		for name := range children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			switch n := children[name].Node().(type) {
+			case *configNode:
+				walk(children[name], path.Join(prefix, name))
+			case *gitConfigNode:
+				mounts = append(mounts, MountStatus{
+					Path:   path.Join(prefix, name),
+					Source: n.content,
+					Commit: n.commit,
+				})
+			}
+		}
+	}
+	walk(fs.config, "")
+	return mounts
+}
+
+func (fs *multiGitFS) status() ([]byte, error) {
+	return formatStatus(fs.mounts()), nil
+}
+
+// statusError returns the error for a failed FUSE operation, or nil.
+func statusError(op, path string, code fuse.Status) error {
+	if code.Ok() {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: path, Err: syscall.Errno(code)}
+}
+
+// splitConfigPath splits a mount path into its directory in the
+// config tree, and its name.
+func (fs *multiGitFS) splitConfigPath(op, p string, create bool) (*configNode, string, error) {
+	clean := path.Clean("/" + p)[1:]
+	if clean == "" || clean != p {
+		return nil, "", &os.PathError{Op: op, Path: p, Err: syscall.EINVAL}
+	}
+	if strings.HasPrefix(clean+"/", "config/") {
+		return nil, "", &os.PathError{Op: op, Path: p, Err: syscall.EPERM}
+	}
+
+	dir := fs.config.Node().(*configNode)
+	components := strings.Split(clean, "/")
+	for _, c := range components[:len(components)-1] {
+		ch := dir.Inode().GetChild(c)
+		if ch == nil {
+			if !create {
+				return nil, "", &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+			}
+			ch, _ = dir.mkdir(c)
+		}
+		next, ok := ch.Node().(*configNode)
+		if !ok {
+			return nil, "", &os.PathError{Op: op, Path: p, Err: syscall.ENOTDIR}
+		}
+		dir = next
+	}
+	return dir, components[len(components)-1], nil
+}
+
+func (fs *multiGitFS) addMount(p, source string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, name, err := fs.splitConfigPath("add", p, true)
+	if err != nil {
+		return err
+	}
+	if dir.Inode().GetChild(name) != nil {
+		return &os.PathError{Op: "add", Path: p, Err: syscall.EEXIST}
+	}
+	root, opts, err := fs.newMountRoot(source)
+	if err != nil {
+		return &os.PathError{Op: "add", Path: p, Err: err}
+	}
+	_, code := dir.mount(name, source, root, opts)
+	return statusError("add", p, code)
+}
+
+func (fs *multiGitFS) removeMount(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, name, err := fs.splitConfigPath("remove", p, false)
+	if err != nil {
+		return err
+	}
+	return statusError("remove", p, dir.unlink(name))
+}
+
+func (fs *multiGitFS) retarget(p, source string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, name, err := fs.splitConfigPath("retarget", p, false)
+	if err != nil {
+		return err
+	}
+	ch := dir.Inode().GetChild(name)
+	if ch == nil {
+		return &os.PathError{Op: "retarget", Path: p, Err: syscall.ENOENT}
+	}
+	old, ok := ch.Node().(*gitConfigNode)
+	if !ok {
+		return &os.PathError{Op: "retarget", Path: p, Err: syscall.EINVAL}
+	}
+
+	// Load the new tree before unmounting the old one, so a bad
+	// source leaves the mount alone.
+	root, opts, err := fs.newMountRoot(source)
+	if err != nil {
+		return &os.PathError{Op: "retarget", Path: p, Err: err}
+	}
+	if code := dir.unlink(name); !code.Ok() {
+		return statusError("retarget", p, code)
+	}
+	if _, code := dir.mount(name, source, root, opts); !code.Ok() {
+		log := logger().With("mount", p)
+		log.Errorf("retargeting to %q: %v; restoring %q", source, code, old.content)
+		if _, restore := dir.symlink(name, old.content); !restore.Ok() {
+			log.Errorf("restoring: %v", restore)
+		}
+		return statusError("retarget", p, code)
+	}
+	return nil
 }
 
 type configNode struct {
@@ -44,13 +246,17 @@ type configNode struct {
 
 	// non-config node corresponding to this one.
 	corresponding nodefs.Node
+
+	// path relative to the config directory.
+	path string
 }
 
-func (fs *multiGitFS) newConfigNode(corresponding nodefs.Node) *configNode {
+func (fs *multiGitFS) newConfigNode(corresponding nodefs.Node, path string) *configNode {
 	return &configNode{
 		fs:            fs,
 		Node:          nodefs.NewDefaultNode(),
 		corresponding: corresponding,
+		path:          path,
 	}
 }
 
@@ -58,6 +264,9 @@ type gitConfigNode struct {
 	nodefs.Node
 
 	content string
+
+	// commit is the commit that was mounted, if any.
+	commit string
 }
 
 func newGitConfigNode(content string) *gitConfigNode {
@@ -77,12 +286,24 @@ func (n *gitConfigNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
 }
 
 func (n *configNode) Mkdir(name string, mode uint32, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	return n.mkdir(name)
+}
+
+func (n *configNode) mkdir(name string) (*nodefs.Inode, fuse.Status) {
 	corr := n.corresponding.Inode().NewChild(name, true, nodefs.NewDefaultNode())
-	c := n.fs.newConfigNode(corr.Node())
+	c := n.fs.newConfigNode(corr.Node(), path.Join(n.path, name))
 	return n.Inode().NewChild(name, true, c), fuse.OK
 }
 
 func (n *configNode) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	return n.unlink(name)
+}
+
+func (n *configNode) unlink(name string) (code fuse.Status) {
 	linkInode := n.Inode().GetChild(name)
 	if linkInode == nil {
 		return fuse.ENOENT
@@ -90,7 +311,7 @@ func (n *configNode) Unlink(name string, context *fuse.Context) (code fuse.Statu
 
 	_, ok := linkInode.Node().(*gitConfigNode)
 	if !ok {
-		log.Printf("gitfs: removing %q, child is not a gitConfigNode", name)
+		logger().With("mount", path.Join(n.path, name)).Warningf("removing config entry that is not a symlink")
 		return fuse.EINVAL
 	}
 
@@ -102,6 +323,7 @@ func (n *configNode) Unlink(name string, context *fuse.Context) (code fuse.Statu
 	code = n.fs.fsConn.Unmount(root)
 	if code.Ok() {
 		n.Inode().RmChild(name)
+		n.fs.statusFile.refresh(n.fs.fsConn)
 	}
 	return code
 }
@@ -133,45 +355,63 @@ func NewGitFSRoot(uri string, opts *GitFSOptions) (nodefs.Node, error) {
 }
 
 func (n *configNode) Symlink(name string, content string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	n.fs.mu.Lock()
+	defer n.fs.mu.Unlock()
+	return n.symlink(name, content)
+}
+
+func (n *configNode) symlink(name string, content string) (*nodefs.Inode, fuse.Status) {
+	root, opts, err := n.fs.newMountRoot(content)
+	if err != nil {
+		// Symlink cannot return the message, so log it.
+		logger().With("source", content).Errorf("%v", err)
+		if errno := errnoOf(err); errno != 0 {
+			return nil, fuse.Status(errno)
+		}
+		return nil, fuse.EIO
+	}
+	return n.mount(name, content, root, opts)
+}
+
+// newMountRoot loads the tree for the content of a config symlink.
+func (fs *multiGitFS) newMountRoot(content string) (nodefs.Node, *nodefs.Options, error) {
 	dir := content
 	components := strings.Split(content, ":")
 	if len(components) > 2 || len(components) == 0 {
-		return nil, fuse.Status(syscall.EINVAL)
+		return nil, nil, syscall.EINVAL
 	}
 
-	var root nodefs.Node
 	if len(components) == 2 {
 		dir = components[0]
 	}
 
 	if fi, err := os.Lstat(dir); err != nil {
-		return nil, fuse.ToStatus(err)
+		return nil, nil, err
 	} else if !fi.IsDir() {
-		return nil, fuse.Status(syscall.ENOTDIR)
+		return nil, nil, &os.PathError{Op: "lstat", Path: dir, Err: syscall.ENOTDIR}
 	}
 
-	var opts *nodefs.Options
 	if len(components) == 1 {
-		root = pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(content), nil).Root()
-	} else {
-		var err error
-		root, err = NewGitFSRoot(content, n.fs.opts)
-		if err != nil {
-			log.Printf("NewGitFSRoot(%q): %v", content, err)
-			return nil, fuse.ENOENT
-		}
-		opts = &nodefs.Options{
-			EntryTimeout:    time.Hour,
-			NegativeTimeout: time.Hour,
-			AttrTimeout:     time.Hour,
-			PortableInodes:  true,
-		}
+		return pathfs.NewPathNodeFs(pathfs.NewLoopbackFileSystem(content), nil).Root(), nil, nil
 	}
 
+	root, err := NewGitFSRoot(content, fs.opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return root, fs.opts.NodefsOptions(), nil
+}
+
+// mount mounts root under name, and adds the config symlink for it.
+func (n *configNode) mount(name, content string, root nodefs.Node, opts *nodefs.Options) (*nodefs.Inode, fuse.Status) {
+	setMountPath(root, path.Join(n.path, name))
 	if code := n.fs.fsConn.Mount(n.corresponding.Inode(), name, root, opts); !code.Ok() {
 		return nil, code
 	}
 
 	linkNode := newGitConfigNode(content)
-	return n.Inode().NewChild(name, false, linkNode), fuse.OK
+	linkNode.commit = rootCommit(root)
+	ch := n.Inode().NewChild(name, false, linkNode)
+	n.fs.statusFile.refresh(n.fs.fsConn)
+	return ch, fuse.OK
 }
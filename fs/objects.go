@@ -0,0 +1,473 @@
+package fs
+
+import (
+	"container/list"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	git "github.com/libgit2/git2go"
+)
+
+// DefaultObjectCacheSize is the memory cap of the cache of object
+// metadata and small blobs of a repository, if
+// GitFSOptions.ObjectCacheSize is not set.
+const DefaultObjectCacheSize = 32 << 20
+
+// smallBlobSize is the size up to which blob contents are cached.
+const smallBlobSize = 64 << 10
+
+// objectOverhead approximates the memory used by a cache entry
+// besides its contents.
+const objectOverhead = 128
+
+// treeEntryOverhead approximates the memory used by an entry of a
+// cached tree besides its name.
+const treeEntryOverhead = 48
+
+// objectStore reads the objects of a repository, and is shared by
+// all trees of the repository. It keeps its own handle of the
+// repository and its object database open while trees using it are
+// mounted. The metadata of the objects it has read (directory
+// listings, blob sizes and symlink targets), which never changes for
+// an object ID, and small blobs are kept in a memory capped cache.
+// It is safe for concurrent use, like the repository.
+type objectStore struct {
+	dir     string
+	repo    *git.Repository
+	odb     *git.Odb
+	metrics *Metrics
+	cache   *objectCache
+
+	// refs counts the mounted trees using the store. It is
+	// guarded by objectStores.
+	refs int
+
+	// borrowed is set for the stores of trees that were not
+	// mounted yet. They read through the repository of the tree,
+	// and are not registered.
+	borrowed bool
+
+	// open is held for reading while using repo and odb, and for
+	// writing to close them.
+	open   sync.RWMutex
+	closed bool
+}
+
+// treeEntry is an entry of a directory listing.
+type treeEntry struct {
+	name string
+	id   git.Oid
+	mode git.Filemode
+}
+
+func (e *treeEntry) isDir() bool {
+	return e.mode&syscall.S_IFDIR != 0
+}
+
+// errStoreClosed is returned when reading from a store that was
+// closed, because the trees using it were unmounted.
+var errStoreClosed = errors.New("gitfs: object store closed")
+
+// objectStores has the open stores, keyed by repoDir. A store is
+// registered while trees using it are mounted.
+var objectStores = struct {
+	sync.Mutex
+	m map[string]*objectStore
+}{m: map[string]*objectStore{}}
+
+// openObjectStore returns the open store of the repository of repo,
+// or if there is none, a store that borrows repo and holds nothing
+// open of its own. The store can be read right away, to build the
+// nodes of a tree, and is exchanged for an open one by acquire. The
+// cache size and metrics are taken from the options of the tree that
+// opens it.
+func openObjectStore(repo *git.Repository, opts *GitFSOptions) (*objectStore, error) {
+	dir := repoDir(repo)
+	objectStores.Lock()
+	defer objectStores.Unlock()
+	if s := objectStores.m[dir]; s != nil {
+		return s, nil
+	}
+	return &objectStore{
+		dir:      dir,
+		repo:     repo,
+		borrowed: true,
+		metrics:  opts.Metrics,
+		cache:    newObjectCache(objectCacheSize(opts)),
+	}, nil
+}
+
+// acquire takes a reference to the open store of the repository for
+// a tree that is mounted, until release. If s is not that store,
+// because it is borrowed or was closed meanwhile, the open store is
+// returned instead, and opened if needed.
+func (s *objectStore) acquire(repo *git.Repository, opts *GitFSOptions) (*objectStore, error) {
+	objectStores.Lock()
+	defer objectStores.Unlock()
+	if cur := objectStores.m[s.dir]; cur != s {
+		if cur == nil {
+			var err error
+			if cur, err = newObjectStore(s.dir, repo.Path(), opts, s.cache); err != nil {
+				return nil, err
+			}
+		}
+		s = cur
+	}
+	s.refs++
+	return s, nil
+}
+
+// release drops a reference taken by acquire. After the last one,
+// the store is closed and forgotten.
+func (s *objectStore) release() {
+	objectStores.Lock()
+	defer objectStores.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	if objectStores.m[s.dir] == s {
+		delete(objectStores.m, s.dir)
+	}
+	s.open.Lock()
+	defer s.open.Unlock()
+	s.closed = true
+	s.odb.Free()
+	s.repo.Free()
+}
+
+// use returns an error if the store is closed, and otherwise returns
+// the object database, and keeps the store open until done is
+// called.
+func (s *objectStore) use() (odb *git.Odb, done func(), err error) {
+	if s.borrowed {
+		odb, err := s.repo.Odb()
+		if err != nil {
+			return nil, nil, err
+		}
+		return odb, odb.Free, nil
+	}
+	s.open.RLock()
+	if s.closed {
+		s.open.RUnlock()
+		return nil, nil, errStoreClosed
+	}
+	return s.odb, s.open.RUnlock, nil
+}
+
+func objectCacheSize(opts *GitFSOptions) int64 {
+	if opts.ObjectCacheSize == 0 {
+		return DefaultObjectCacheSize
+	}
+	return opts.ObjectCacheSize
+}
+
+// newObjectStore opens the repository at path, and registers a store
+// for it as that of dir, which keeps the entries of cache. It must be
+// called with objectStores locked.
+func newObjectStore(dir, path string, opts *GitFSOptions, cache *objectCache) (*objectStore, error) {
+	repo, err := git.OpenRepository(path)
+	if err != nil {
+		return nil, err
+	}
+	odb, err := repo.Odb()
+	if err != nil {
+		repo.Free()
+		return nil, err
+	}
+	s := &objectStore{
+		dir:     dir,
+		repo:    repo,
+		odb:     odb,
+		metrics: opts.Metrics,
+		cache:   cache,
+	}
+	objectStores.m[dir] = s
+	return s, nil
+}
+
+// tree returns the listing of a tree. It must not be modified.
+func (s *objectStore) tree(id *git.Oid) ([]treeEntry, error) {
+	e, ok := s.cache.get(*id)
+	ok = ok && e.tree != nil
+	s.metrics.objectCache(ok)
+	if ok {
+		return e.tree, nil
+	}
+
+	_, done, err := s.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	start := time.Now()
+	tree, err := s.repo.LookupTree(id)
+	s.metrics.observeODB(start)
+	if err != nil {
+		return nil, err
+	}
+	defer tree.Free()
+
+	entries := make([]treeEntry, 0, tree.EntryCount())
+	for i := uint64(0); ; i++ {
+		e := tree.EntryByIndex(i)
+		if e == nil {
+			break
+		}
+		entries = append(entries, treeEntry{e.Name, *e.Id, e.Filemode})
+	}
+
+	s.cache.addTree(*id, entries)
+	return entries, nil
+}
+
+// isTree returns whether id is a tree.
+func (s *objectStore) isTree(id *git.Oid) bool {
+	if e, ok := s.cache.get(*id); ok {
+		return e.tree != nil
+	}
+	odb, done, err := s.use()
+	if err != nil {
+		return false
+	}
+	defer done()
+	_, t, err := odb.ReadHeader(id)
+	return err == nil && t == git.ObjectTree
+}
+
+// size returns the size of a blob.
+func (s *objectStore) size(id *git.Oid) (uint64, error) {
+	e, ok := s.cache.get(*id)
+	s.metrics.objectCache(ok)
+	if ok {
+		return e.size, nil
+	}
+
+	odb, done, err := s.use()
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	sz, _, err := odb.ReadHeader(id)
+	s.metrics.observeODB(start)
+	done()
+	if err != nil {
+		return 0, err
+	}
+	s.cache.add(*id, sz, nil)
+	return sz, nil
+}
+
+// linkTarget returns the target of a symlink. It must not be
+// modified.
+func (s *objectStore) linkTarget(id *git.Oid) ([]byte, error) {
+	e, ok := s.cache.get(*id)
+	ok = ok && e.data != nil
+	s.metrics.objectCache(ok)
+	if ok {
+		return e.data, nil
+	}
+
+	_, done, err := s.use()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	blob, err := s.repo.LookupBlob(id)
+	s.metrics.observeODB(start)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	target := append([]byte{}, blob.Contents()...)
+	blob.Free()
+	done()
+
+	s.cache.add(*id, uint64(len(target)), target)
+	return target, nil
+}
+
+// smallBlob returns the contents of a blob, if it is at most
+// smallBlobSize long. The contents must not be modified.
+func (s *objectStore) smallBlob(id *git.Oid) (data []byte, ok bool, err error) {
+	e, known := s.cache.get(*id)
+	if e.data != nil {
+		s.metrics.objectCache(true)
+		return e.data, true, nil
+	}
+	if known && e.size > smallBlobSize {
+		return nil, false, nil
+	}
+	s.metrics.objectCache(false)
+
+	odb, done, err := s.use()
+	if err != nil {
+		return nil, false, err
+	}
+	defer done()
+	start := time.Now()
+	obj, err := odb.Read(id)
+	s.metrics.observeODB(start)
+	if err != nil {
+		return nil, false, err
+	}
+	defer obj.Free()
+
+	sz := obj.Len()
+	if sz > smallBlobSize {
+		s.cache.add(*id, sz, nil)
+		return nil, false, nil
+	}
+	data = append(make([]byte, 0, sz), obj.Data()...)
+	s.cache.add(*id, sz, data)
+	return data, true, nil
+}
+
+// cacheOnDisk writes a blob to the disk cache in dir, unless it is
+// there already, and returns its path.
+func (s *objectStore) cacheOnDisk(dir string, id *git.Oid) (p string, hit bool, err error) {
+	p = filepath.Join(dir, id.String())
+	if _, err := os.Lstat(p); err == nil || !os.IsNotExist(err) {
+		return p, err == nil, err
+	}
+
+	_, done, err := s.use()
+	if err != nil {
+		return "", false, err
+	}
+	defer done()
+	start := time.Now()
+	blob, err := s.repo.LookupBlob(id)
+	s.metrics.observeODB(start)
+	if err != nil {
+		return "", false, err
+	}
+	defer blob.Free()
+
+	// Write a temporary file and rename it, so concurrent opens
+	// never read a partial blob.
+	tmp, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return "", false, err
+	}
+	_, err = tmp.Write(blob.Contents())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", false, err
+	}
+	return p, false, nil
+}
+
+// warm loads a blob into the cache that opening it with opts reads
+// from: the disk cache, or the object cache for small blobs. It
+// returns false for blobs that are too large for the object cache.
+func (s *objectStore) warm(opts *GitFSOptions, id *git.Oid) (bool, error) {
+	if opts.Disk {
+		_, _, err := s.cacheOnDisk(opts.TempDir, id)
+		return err == nil, err
+	}
+	_, ok, err := s.smallBlob(id)
+	return ok, err
+}
+
+type objectEntry struct {
+	id   git.Oid
+	size uint64
+
+	// data is the contents, or nil if only the size is known.
+	data []byte
+
+	// tree is the listing, for trees.
+	tree []treeEntry
+}
+
+func (e *objectEntry) cost() int64 {
+	c := int64(len(e.data)) + objectOverhead
+	for i := range e.tree {
+		c += int64(len(e.tree[i].name)) + treeEntryOverhead
+	}
+	return c
+}
+
+// objectCache is an LRU cache of objects, capped by memory use.
+type objectCache struct {
+	mu   sync.Mutex
+	max  int64
+	used int64
+
+	// lru has the most recently used entries at the front.
+	lru     *list.List
+	entries map[git.Oid]*list.Element
+}
+
+func newObjectCache(max int64) *objectCache {
+	return &objectCache{
+		max:     max,
+		lru:     list.New(),
+		entries: map[git.Oid]*list.Element{},
+	}
+}
+
+func (c *objectCache) get(id git.Oid) (objectEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		return objectEntry{}, false
+	}
+	c.lru.MoveToFront(el)
+	return *el.Value.(*objectEntry), true
+}
+
+// add adds or replaces the entry of a blob, evicting the least
+// recently used ones to stay under the cap.
+func (c *objectCache) add(id git.Oid, size uint64, data []byte) {
+	c.put(&objectEntry{id: id, size: size, data: data})
+}
+
+// addTree adds the listing of a tree, like add.
+func (c *objectCache) addTree(id git.Oid, entries []treeEntry) {
+	c.put(&objectEntry{id: id, tree: entries})
+}
+
+func (c *objectCache) put(e *objectEntry) {
+	if e.cost() > c.max {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.id]; ok {
+		old := el.Value.(*objectEntry)
+		if old.data != nil && e.data == nil && e.tree == nil {
+			c.lru.MoveToFront(el)
+			return
+		}
+		c.used -= old.cost()
+		c.lru.Remove(el)
+	}
+	c.entries[e.id] = c.lru.PushFront(e)
+	c.used += e.cost()
+
+	for c.used > c.max {
+		el := c.lru.Back()
+		old := el.Value.(*objectEntry)
+		c.lru.Remove(el)
+		delete(c.entries, old.id)
+		c.used -= old.cost()
+	}
+}
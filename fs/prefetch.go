@@ -0,0 +1,50 @@
+package fs
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	git "github.com/libgit2/git2go"
+)
+
+// prefetch starts loading the small blobs of the directory in the
+// background, the first time it is called. Tools that list a
+// directory or open one of its files usually go on to read most of
+// the others.
+func (n *dirNode) prefetch() {
+	if n.fs.prefetch == nil || !atomic.CompareAndSwapInt32(&n.prefetched, 0, 1) {
+		return
+	}
+	id, _ := n.target()
+	go n.fs.prefetchDir(id, n.path)
+}
+
+// prefetchDir loads the small blobs of a directory into the disk
+// cache, or the object cache if the tree is not read from disk.
+func (t *treeFS) prefetchDir(id *git.Oid, dir string) {
+	entries, err := t.objects.tree(id)
+	if err != nil {
+		t.log.With("path", dir).Warningf("prefetch: %v", err)
+		return
+	}
+
+	for i := range entries {
+		e := &entries[i]
+		if e.mode&^07777 != syscall.S_IFREG {
+			continue
+		}
+		if sz, err := t.objects.size(&e.id); err != nil || sz > smallBlobSize {
+			continue
+		}
+
+		t.prefetch <- struct{}{}
+		go func() {
+			defer func() { <-t.prefetch }()
+			if _, err := t.objects.warm(&t.opts, &e.id); err != nil {
+				t.log.With("path", dir).Warningf("prefetch %s: %v", e.name, err)
+				return
+			}
+			t.opts.Metrics.prefetched()
+		}()
+	}
+}
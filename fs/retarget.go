@@ -0,0 +1,163 @@
+package fs
+
+import (
+	"path"
+	"sync/atomic"
+	"syscall"
+
+	git "github.com/libgit2/git2go"
+
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// canRetarget returns whether the tree mounted at root can be
+// switched to the tree of to in place: both must be roots returned
+// by NewTreeFSRoot, for the same repository.
+func canRetarget(root, to nodefs.Node) bool {
+	r, ok := root.(*dirNode)
+	if !ok || r.path != "" {
+		return false
+	}
+	t, ok := to.(*dirNode)
+	return ok && t.path == "" && repoDir(r.fs.repo) == repoDir(t.fs.repo)
+}
+
+// retarget switches the tree mounted at root to the tree and commit
+// of to, which is not mounted, without unmounting root. Nodes whose
+// object did not change are kept, so their open files and what the
+// kernel cached for them stay valid. The paths in keep, relative to
+// root, are left alone together with the directories leading to
+// them; they are nested mounts, and files added to the tree. The
+// kernel is told about the entries that changed.
+func retarget(conn *nodefs.FileSystemConnector, root, to *dirNode, keep []string) error {
+	t := root.fs
+	id, commit := to.target()
+	t.mu.Lock()
+	t.commit = commit
+	t.mu.Unlock()
+	return t.merge(conn, root, id, "", keep)
+}
+
+// merge updates the children of n, the directory at dir, to the
+// entries of the tree id, or to no entries if id is nil.
+func (t *treeFS) merge(conn *nodefs.FileSystemConnector, n *dirNode, id *git.Oid, dir string, keep []string) error {
+	var entries []treeEntry
+	if id != nil {
+		var err error
+		if entries, err = t.objects.tree(id); err != nil {
+			return err
+		}
+		t.mu.Lock()
+		n.id = id
+		t.mu.Unlock()
+		atomic.StoreInt32(&n.prefetched, 0)
+	}
+
+	todo := map[string]*treeEntry{}
+	for i := range entries {
+		todo[entries[i].name] = &entries[i]
+	}
+	changed := map[string]bool{}
+	inode := n.Inode()
+	for name, ch := range inode.Children() {
+		p := path.Join(dir, name)
+		e := todo[name]
+		delete(todo, name)
+
+		g := toGitNode(ch.Node())
+		if g != nil && g.fs != t {
+			g = nil
+		}
+		d, isDir := ch.Node().(*dirNode)
+		isDir = isDir && g != nil
+		switch {
+		case g != nil && e != nil && *g.id == e.id && sameType(ch.Node(), e):
+		case leadsTo(p, keep):
+			if isDir && !containsString(keep, p) {
+				var sub *git.Oid
+				if e != nil && e.isDir() {
+					sub = &e.id
+				}
+				if err := t.merge(conn, d, sub, p, keep); err != nil {
+					return err
+				}
+			}
+		case isDir && e != nil && e.isDir():
+			if err := t.merge(conn, d, &e.id, p, keep); err != nil {
+				return err
+			}
+		default:
+			files, bytes := t.count(ch)
+			t.stats.add(-files, -bytes)
+			inode.RmChild(name)
+			changed[name] = true
+			if e != nil {
+				todo[name] = e
+			}
+		}
+	}
+
+	for i := range entries {
+		e := &entries[i]
+		if todo[e.name] == nil {
+			continue
+		}
+		p := path.Join(dir, e.name)
+		ch, err := t.newChild(e, n, p)
+		if err != nil {
+			return err
+		}
+		inode.NewChild(e.name, e.isDir(), ch)
+		t.stats.add(1, nodeBytes(ch))
+		if e.isDir() {
+			if err := t.recurse(&e.id, ch, p); err != nil {
+				return err
+			}
+		}
+		changed[e.name] = true
+	}
+
+	for name := range changed {
+		conn.EntryNotify(inode, name)
+	}
+	return nil
+}
+
+// sameType returns whether n, a node of a tree, has the type and mode
+// of e.
+func sameType(n nodefs.Node, e *treeEntry) bool {
+	switch c := n.(type) {
+	case *dirNode:
+		return e.isDir()
+	case *blobNode:
+		return c.mode == e.mode
+	case *linkNode:
+		return e.mode&^07777 == syscall.S_IFLNK
+	}
+	return false
+}
+
+// leadsTo returns whether one of paths is p or inside it.
+func leadsTo(p string, paths []string) bool {
+	for _, q := range paths {
+		if nestedIn(q, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns the number of nodes of t in the subtree of in, and
+// the size of their objects, as counted by the stats.
+func (t *treeFS) count(in *nodefs.Inode) (files, bytes int64) {
+	if g := toGitNode(in.Node()); g == nil || g.fs != t {
+		return 0, 0
+	}
+	files, bytes = 1, nodeBytes(in.Node())
+	for _, ch := range in.Children() {
+		f, b := t.count(ch)
+		files += f
+		bytes += b
+	}
+	return files, bytes
+}
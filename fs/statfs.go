@@ -0,0 +1,112 @@
+package fs
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// treeStats counts the nodes of a tree, and the size of its blobs.
+type treeStats struct {
+	files int64
+	bytes int64
+}
+
+func (s *treeStats) add(files, bytes int64) {
+	atomic.AddInt64(&s.files, files)
+	atomic.AddInt64(&s.bytes, bytes)
+}
+
+func (s *treeStats) reset() {
+	atomic.StoreInt64(&s.files, 0)
+	atomic.StoreInt64(&s.bytes, 0)
+}
+
+func (s *treeStats) get() (files, bytes int64) {
+	return atomic.LoadInt64(&s.files), atomic.LoadInt64(&s.bytes)
+}
+
+// cacheDir returns the directory of the disk cache for opts, whose
+// free space is reported as that of the filesystem.
+func cacheDir(opts *GitFSOptions) string {
+	if opts != nil && opts.TempDir != "" {
+		return opts.TempDir
+	}
+	return os.TempDir()
+}
+
+// statFs reports files nodes, and bytes of blobs, as the used inodes
+// and blocks of a filesystem, whose free inodes and blocks are those
+// of the filesystem holding dir.
+func statFs(dir string, files, bytes int64) *fuse.StatfsOut {
+	out := &fuse.StatfsOut{
+		Bsize:   4096,
+		NameLen: 255,
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err == nil {
+		out.Bsize = uint32(st.Bsize)
+		out.Bfree = st.Bfree
+		out.Bavail = st.Bavail
+		out.Ffree = st.Ffree
+	}
+	out.Frsize = out.Bsize
+	out.Files = uint64(files) + out.Ffree
+	out.Blocks = (uint64(bytes)+uint64(out.Bsize)-1)/uint64(out.Bsize) + out.Bfree
+	return out
+}
+
+// StatFs reports on the whole tree, also for its subdirectories.
+func (n *dirNode) StatFs() *fuse.StatfsOut {
+	files, bytes := n.fs.stats.get()
+	return statFs(cacheDir(&n.fs.opts), files, bytes)
+}
+
+// treeRoots returns the roots of the trees mounted below dir.
+func treeRoots(dir *nodefs.Inode) []*dirNode {
+	var roots []*dirNode
+	for _, ch := range dir.Children() {
+		if n, ok := ch.Node().(*dirNode); ok {
+			if n.path == "" {
+				roots = append(roots, n)
+			}
+			continue
+		}
+		if ch.IsDir() {
+			roots = append(roots, treeRoots(ch)...)
+		}
+	}
+	return roots
+}
+
+// sumStats adds up the stats of trees.
+func sumStats(roots []*dirNode) (files, bytes int64) {
+	for _, r := range roots {
+		f, b := r.fs.stats.get()
+		files += f
+		bytes += b
+	}
+	return files, bytes
+}
+
+func (r *multiGitRoot) StatFs() *fuse.StatfsOut {
+	files, bytes := sumStats(treeRoots(r.Inode()))
+	return statFs(cacheDir(r.fs.opts), files, bytes)
+}
+
+func (r *manifestFSRoot) StatFs() *fuse.StatfsOut {
+	r.mu.Lock()
+	var roots []*dirNode
+	for _, n := range r.repoMap {
+		if root, ok := n.(*dirNode); ok {
+			roots = append(roots, root)
+		}
+	}
+	r.mu.Unlock()
+
+	files, bytes := sumStats(roots)
+	return statFs(cacheDir(r.gitOpts), files, bytes)
+}
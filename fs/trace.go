@@ -0,0 +1,134 @@
+package fs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Tracer records which files in git trees are accessed. Set it in
+// GitFSOptions to trace all trees mounted with those options.
+type Tracer struct {
+	// active is 1 while tracing, so inactive tracers cost only an
+	// atomic load.
+	active int32
+
+	mu      sync.Mutex
+	entries map[traceKey]*TraceEntry
+}
+
+type traceKey struct {
+	repo, path string
+}
+
+// TraceEntry is a file or directory accessed during a trace.
+type TraceEntry struct {
+	// Repo is the directory of the repository, or its work
+	// tree.
+	Repo string
+
+	// Commit is the commit that was mounted, if known.
+	Commit string `json:",omitempty"`
+
+	// Path is the path in the tree, and ID the SHA1 of the blob
+	// or tree.
+	Path string
+	ID   string
+
+	// Ops are the operations done on the file, eg. "open", and
+	// Pids the processes that did them.
+	Ops  []string
+	Pids []uint32
+}
+
+// NewTracer returns a Tracer that is not tracing yet.
+func NewTracer() *Tracer {
+	return &Tracer{}
+}
+
+// Start discards the previous trace, and starts a new one.
+func (t *Tracer) Start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = map[traceKey]*TraceEntry{}
+	atomic.StoreInt32(&t.active, 1)
+}
+
+// Stop stops tracing. The trace is kept until the next Start.
+func (t *Tracer) Stop() {
+	atomic.StoreInt32(&t.active, 0)
+}
+
+// Entries returns the trace so far, sorted by repository and path.
+func (t *Tracer) Entries() []TraceEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var entries []TraceEntry
+	for _, e := range t.entries {
+		c := *e
+		c.Ops = append([]string{}, e.Ops...)
+		c.Pids = append([]uint32{}, e.Pids...)
+		entries = append(entries, c)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Repo != entries[j].Repo {
+			return entries[i].Repo < entries[j].Repo
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// record adds an operation on n to the trace, if tracing. It may be
+// called with a nil Tracer.
+func (t *Tracer) record(n *gitNode, op string, context *fuse.Context) {
+	if t == nil || atomic.LoadInt32(&t.active) == 0 {
+		return
+	}
+
+	repo := repoDir(n.fs.repo)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := traceKey{repo, n.path}
+	e := t.entries[key]
+	if e == nil {
+		id, commit := n.target()
+		e = &TraceEntry{
+			Repo: repo,
+			Path: n.path,
+			ID:   id.String(),
+		}
+		if commit != nil {
+			e.Commit = commit.String()
+		}
+		t.entries[key] = e
+	}
+	if !containsString(e.Ops, op) {
+		e.Ops = append(e.Ops, op)
+	}
+	if context != nil && !containsPid(e.Pids, context.Pid) {
+		e.Pids = append(e.Pids, context.Pid)
+	}
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPid(l []uint32, pid uint32) bool {
+	for _, e := range l {
+		if e == pid {
+			return true
+		}
+	}
+	return false
+}
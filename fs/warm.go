@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	git "github.com/libgit2/git2go"
+
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// WarmTarget is a file to load into the cache. It is either a Path
+// in the mount, or the blob ID of a repository, as listed by a
+// trace.
+type WarmTarget struct {
+	Path string `json:",omitempty"`
+
+	Repo string `json:",omitempty"`
+	ID   string `json:",omitempty"`
+}
+
+// WarmResult is the outcome of Warm.
+type WarmResult struct {
+	// Blobs and Bytes count the blobs that were loaded, and
+	// their total size.
+	Blobs int
+	Bytes int64
+
+	// Skipped counts the blobs that are too large for the
+	// memory cache, without -disk; they are read when opened.
+	Skipped int
+
+	Seconds float64
+
+	// Errors has a message for each target that could not be
+	// loaded.
+	Errors []string `json:",omitempty"`
+}
+
+// DefaultWarmParallel is the number of blobs Warm loads at once, if
+// not specified.
+const DefaultWarmParallel = 16
+
+// Warm loads the blobs of targets into the cache that opening them
+// reads from, which is the disk cache if opts.Disk is set, loading at
+// most parallel blobs at once. Paths are relative to root, the root
+// of a mount served by conn, and targets that are not regular files
+// are skipped. IDs are looked up in the repositories of the mounted
+// trees, skipping those of their directories.
+func Warm(conn *nodefs.FileSystemConnector, root nodefs.Node, opts *GitFSOptions, targets []WarmTarget, parallel int) *WarmResult {
+	start := time.Now()
+	if parallel <= 0 {
+		parallel = DefaultWarmParallel
+	}
+
+	type blob struct {
+		objects *objectStore
+		id      *git.Oid
+	}
+	var blobs []blob
+	seen := map[git.Oid]bool{}
+	res := &WarmResult{}
+	for _, t := range targets {
+		var b blob
+		if t.ID != "" {
+			b.objects = findObjectStore(t.Repo)
+			if b.objects == nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("%s: repository not mounted", t.Repo))
+				continue
+			}
+			id, err := git.NewOid(t.ID)
+			if err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", t.ID, err))
+				continue
+			}
+			if b.objects.isTree(id) {
+				continue
+			}
+			b.id = id
+		} else {
+			p := strings.Trim(path.Clean("/"+t.Path), "/")
+			inode, rest := conn.Node(root.Inode(), p)
+			if inode == nil || len(rest) > 0 {
+				res.Errors = append(res.Errors, fmt.Sprintf("%s: not found", t.Path))
+				continue
+			}
+			n, ok := inode.Node().(*blobNode)
+			if !ok {
+				continue
+			}
+			b.objects, b.id = n.fs.objects, n.id
+		}
+		if !seen[*b.id] {
+			seen[*b.id] = true
+			blobs = append(blobs, b)
+		}
+	}
+
+	var mu sync.Mutex
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for _, b := range blobs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(b blob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			sz, err := b.objects.size(b.id)
+			loaded := false
+			if err == nil {
+				loaded, err = b.objects.warm(opts, b.id)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("%s: %v", b.id, err))
+				return
+			}
+			if !loaded {
+				res.Skipped++
+				return
+			}
+			res.Blobs++
+			res.Bytes += int64(sz)
+		}(b)
+	}
+	wg.Wait()
+
+	res.Seconds = time.Since(start).Seconds()
+	return res
+}
+
+// findObjectStore returns the store of the repository in dir, if it
+// has mounted trees.
+func findObjectStore(dir string) *objectStore {
+	objectStores.Lock()
+	defer objectStores.Unlock()
+	return objectStores.m[filepath.Clean(dir)]
+}
+
+// HandleWarm registers Warm, which calls Warm for the filesystem
+// mounted at mnt. Absolute paths must be below mnt.
+func (s *ControlServer) HandleWarm(conn *nodefs.FileSystemConnector, root nodefs.Node, mnt string, opts *GitFSOptions) {
+	s.Handle("Warm", func(req *ControlRequest) (*ControlResponse, error) {
+		targets := append([]WarmTarget{}, req.Targets...)
+		for i, t := range targets {
+			if filepath.IsAbs(t.Path) {
+				rel, err := filepath.Rel(mnt, t.Path)
+				if err != nil || strings.HasPrefix(rel, "..") {
+					return nil, &ControlError{Op: req.Method, Path: t.Path, Message: fmt.Sprintf("%s is not below %s", t.Path, mnt)}
+				}
+				targets[i].Path = rel
+			}
+		}
+		return &ControlResponse{Warm: Warm(conn, root, opts, targets, req.Parallel)}, nil
+	})
+}
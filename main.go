@@ -1,74 +1,56 @@
 package main
 
 import (
-	"flag"
-	"io/ioutil"
-	"log"
+	"fmt"
 	"os"
-	"path/filepath"
-	"time"
-
-	"github.com/hanwen/gitfs/fs"
-	"github.com/hanwen/gitfs/manifest"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
 )
 
-func main() {
-	debug := flag.Bool("debug", false, "print FUSE debug data")
-	lazy := flag.Bool("lazy", true, "only read contents for reads")
-	disk := flag.Bool("disk", false, "don't use intermediate files")
-	gitRepo := flag.String("git_repo", "", "if set, mount a single repository.")
-	repo := flag.String("repo", "", "if set, mount a single manifest from repo repository.")
-	flag.Parse()
-	if len(flag.Args()) < 1 {
-		log.Fatalf("usage: %s MOUNT", os.Args[0])
-	}
+// commands maps subcommand names to their implementation.
+var commands = map[string]func(args []string){
+	"mount":         mountCmd,
+	"unmount":       unmountCmd,
+	"status":        statusCmd,
+	"ls-mounts":     lsMountsCmd,
+	"add":           addCmd,
+	"remove":        removeCmd,
+	"manifest-diff": manifestDiffCmd,
+	"control":       controlCmd,
+	"trace":         traceCmd,
+	"restrict":      restrictCmd,
+	"warm":          warmCmd,
+}
 
-	tempDir, err := ioutil.TempDir("", "gitfs")
-	if err != nil {
-		log.Fatalf("TempDir: %v", err)
-	}
+const usage = `usage: %[1]s COMMAND [ARGS]
 
-	mntDir := flag.Args()[0]
-	opts := fs.GitFSOptions{
-		Lazy:    *lazy,
-		Disk:    *disk,
-		TempDir: tempDir,
-	}
-	var root nodefs.Node
-	if *repo != "" {
-		xml := filepath.Join(*repo, "manifest.xml")
+commands:
+  mount [FLAGS] MOUNT              mount a gitfs filesystem and serve it
+  unmount [-lazy] MOUNT            unmount a gitfs filesystem
+  status MOUNT                     list what is mounted where, at which commit
+  ls-mounts                        list the gitfs filesystems
+  add [-symlink] REPO-DIR:TREEISH PATH
+                                   mount a repository at PATH in a multi-repo mount
+  remove [-symlink] PATH           remove a repository from a multi-repo mount
+  manifest-diff [-log REPO] A B    compare two manifests or manifest mounts
+  control SOCKET METHOD [ARGS]     call the control API of a "mount -control SOCKET"
+  trace SOCKET start|stop|dump     trace which files are accessed
+  restrict SOCKET ALLOW-FILE CMD   run CMD, only showing it the paths in ALLOW-FILE
+  warm [-j N] MOUNT < FILE         load the files listed in FILE, or a trace, into the cache
 
-		m, err := manifest.ParseFile(xml)
-		if err != nil {
-			log.Fatalf("ParseFile(%q): %v", *repo, err)
-		}
+"%[1]s MOUNT" is short for "%[1]s mount MOUNT".
+`
 
-		root, err = fs.NewManifestFS(m, filepath.Join(*repo, "projects"), &opts)
-		if err != nil {
-			log.Fatalf("NewManifestFS: %v", err)
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
 		}
-	} else if *gitRepo != "" {
-		var err error
-		root, err = fs.NewGitFSRoot(*gitRepo, &opts)
-		if err != nil {
-			log.Fatalf("NewGitFSRoot: %v", err)
+		if os.Args[1] == "help" || os.Args[1] == "-help" || os.Args[1] == "--help" {
+			fmt.Fprintf(os.Stderr, usage, os.Args[0])
+			return
 		}
-	} else {
-		root = fs.NewMultiGitFSRoot(&opts)
-	}
-	server, _, err := nodefs.MountRoot(mntDir, root, &nodefs.Options{
-		EntryTimeout:    time.Hour,
-		NegativeTimeout: time.Hour,
-		AttrTimeout:     time.Hour,
-		PortableInodes:  true,
-	})
-	if err != nil {
-		log.Fatalf("MountFileSystem: %v", err)
 	}
-	if *debug {
-		server.SetDebug(true)
-	}
-	log.Printf("Started git multi fs FUSE on %s", mntDir)
-	server.Serve()
+
+	// For compatibility, "gitfs [FLAGS] MOUNT" mounts.
+	mountCmd(os.Args[1:])
 }
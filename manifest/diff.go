@@ -0,0 +1,112 @@
+package manifest
+
+import (
+	"fmt"
+	"io"
+)
+
+// ProjectChange is a project that exists in both manifests of a
+// Diff, but with a different path or revision.
+type ProjectChange struct {
+	Old, New Project
+
+	// OldRevision and NewRevision are the effective revisions,
+	// taking defaults into account.
+	OldRevision, NewRevision string
+}
+
+// Changes lists the differences between two manifests. A project
+// that was both moved and repinned is listed in both.
+type Changes struct {
+	Added    []Project
+	Removed  []Project
+	Moved    []ProjectChange
+	Repinned []ProjectChange
+}
+
+// Empty returns whether the manifests have the same projects.
+func (c *Changes) Empty() bool {
+	return len(c.Added)+len(c.Removed)+len(c.Moved)+len(c.Repinned) == 0
+}
+
+// Diff computes how the projects in b differ from those in a.
+// Projects are matched by name; if a name is used several times,
+// projects at the same path are matched first.
+func Diff(a, b *Manifest) *Changes {
+	var c Changes
+
+	byName := map[string][]Project{}
+	for _, p := range a.Project {
+		byName[p.Name] = append(byName[p.Name], p)
+	}
+
+	var unmatched []Project
+	for _, p := range b.Project {
+		old := byName[p.Name]
+		idx := -1
+		for i, o := range old {
+			if o.Path == p.Path {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 && len(old) > 0 {
+			idx = 0
+		}
+		if idx < 0 {
+			unmatched = append(unmatched, p)
+			continue
+		}
+
+		o := old[idx]
+		byName[p.Name] = append(old[:idx:idx], old[idx+1:]...)
+
+		change := ProjectChange{
+			Old:         o,
+			New:         p,
+			OldRevision: a.ProjectRevision(&o),
+			NewRevision: b.ProjectRevision(&p),
+		}
+		if o.Path != p.Path {
+			c.Moved = append(c.Moved, change)
+		}
+		if change.OldRevision != change.NewRevision {
+			c.Repinned = append(c.Repinned, change)
+		}
+	}
+	c.Added = unmatched
+
+	for _, p := range a.Project {
+		for _, o := range byName[p.Name] {
+			if o.Path == p.Path {
+				c.Removed = append(c.Removed, o)
+			}
+		}
+	}
+	return &c
+}
+
+// Write prints the changes in a human readable format.
+func (c *Changes) Write(w io.Writer) error {
+	for _, p := range c.Added {
+		if _, err := fmt.Fprintf(w, "added    %s at %s\n", p.Name, p.Path); err != nil {
+			return err
+		}
+	}
+	for _, p := range c.Removed {
+		if _, err := fmt.Fprintf(w, "removed  %s at %s\n", p.Name, p.Path); err != nil {
+			return err
+		}
+	}
+	for _, ch := range c.Moved {
+		if _, err := fmt.Fprintf(w, "moved    %s: %s -> %s\n", ch.New.Name, ch.Old.Path, ch.New.Path); err != nil {
+			return err
+		}
+	}
+	for _, ch := range c.Repinned {
+		if _, err := fmt.Fprintf(w, "repinned %s: %s -> %s\n", ch.New.Name, ch.OldRevision, ch.NewRevision); err != nil {
+			return err
+		}
+	}
+	return nil
+}
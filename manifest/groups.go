@@ -0,0 +1,54 @@
+package manifest
+
+import (
+	"regexp"
+)
+
+var groupSeparator = regexp.MustCompile(`[,\s]+`)
+
+// ParseGroups splits a group specification such as
+// "default,-notdefault,platform-linux" into its elements. An empty
+// specification selects the "default" group, like repo's -g option.
+func ParseGroups(spec string) []string {
+	var r []string
+	for _, g := range groupSeparator.Split(spec, -1) {
+		if g != "" {
+			r = append(r, g)
+		}
+	}
+	if len(r) == 0 {
+		r = []string{"default"}
+	}
+	return r
+}
+
+// MatchGroups returns whether the project is selected by the given
+// groups, following repo's semantics: elements are evaluated in
+// order, a "-" prefix excludes a group, and every project implicitly
+// belongs to "all", "name:NAME" and "path:PATH". Projects not in
+// "notdefault" are also in "default".
+func (p *Project) MatchGroups(groups []string) bool {
+	projectGroups := map[string]bool{
+		"all":            true,
+		"name:" + p.Name: true,
+		"path:" + p.Path: true,
+	}
+	for g := range p.Groups {
+		projectGroups[g] = true
+	}
+	if !projectGroups["notdefault"] {
+		projectGroups["default"] = true
+	}
+
+	matched := false
+	for _, g := range groups {
+		if len(g) > 1 && g[0] == '-' {
+			if projectGroups[g[1:]] {
+				matched = false
+			}
+		} else if projectGroups[g] {
+			matched = true
+		}
+	}
+	return matched
+}
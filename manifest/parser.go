@@ -1,41 +1,75 @@
 package manifest
 
 import (
+	"bytes"
 	"encoding/xml"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
 	"strings"
 )
 
-var _ = xml.Unmarshal
+// Unknown holds an element that is not modeled by this package, so
+// it can be written back unchanged.
+type Unknown struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+type Annotation struct {
+	Name  string `xml:"name,attr,omitempty"`
+	Value string `xml:"value,attr,omitempty"`
+	Keep  string `xml:"keep,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
+}
 
 type Copyfile struct {
-	Src  string `xml:"src,attr"`
-	Dest string `xml:"dest,attr"`
+	Src  string `xml:"src,attr,omitempty"`
+	Dest string `xml:"dest,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
 }
 
 type Linkfile struct {
-	Src  string `xml:"src,attr"`
-	Dest string `xml:"dest,attr"`
+	Src  string `xml:"src,attr,omitempty"`
+	Dest string `xml:"dest,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
 }
 
 type Project struct {
-	Path         string     `xml:"path,attr"`
-	Name         string     `xml:"name,attr"`
-	Remote       string     `xml:"remote,attr"`
-	Copyfile     []Copyfile `xml:"copyfile"`
-	Linkfile     []Linkfile `xml:"linkfile"`
-	GroupsString string     `xml:"groups,attr"`
-	Groups       map[string]bool
+	Path         string          `xml:"path,attr,omitempty"`
+	Name         string          `xml:"name,attr,omitempty"`
+	Remote       string          `xml:"remote,attr,omitempty"`
+	Annotation   []Annotation    `xml:"annotation"`
+	Project      []Project       `xml:"project"`
+	Copyfile     []Copyfile      `xml:"copyfile"`
+	Linkfile     []Linkfile      `xml:"linkfile"`
+	GroupsString string          `xml:"groups,attr,omitempty"`
+	Groups       map[string]bool `xml:"-"`
+
+	Revision   string `xml:"revision,attr,omitempty"`
+	DestBranch string `xml:"dest-branch,attr,omitempty"`
+	SyncJ      string `xml:"sync-j,attr,omitempty"`
+	SyncC      string `xml:"sync-c,attr,omitempty"`
+	SyncS      string `xml:"sync-s,attr,omitempty"`
+	SyncTags   string `xml:"sync-tags,attr,omitempty"`
+
+	Upstream   string `xml:"upstream,attr,omitempty"`
+	CloneDepth string `xml:"clone-depth,attr,omitempty"`
+	ForcePath  string `xml:"force-path,attr,omitempty"`
 
-	Revision   string `xml:"revision,attr"`
-	DestBranch string `xml:"dest-branch,attr"`
-	SyncJ      string `xml:"sync-j,attr"`
-	SyncC      string `xml:"sync-c,attr"`
-	SyncS      string `xml:"sync-s,attr"`
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
+	Unknown      []Unknown  `xml:",any"`
 
-	Upstream   string `xml:"upstream,attr"`
-	CloneDepth string `xml:"clone-depth,attr"`
-	ForcePath  string `xml:"force-path,attr"`
+	// Parent is the project a subproject was nested in, as set by
+	// Manifest.Effective.
+	Parent *Project `xml:"-"`
 }
 
 func (p *Project) parse() {
@@ -48,32 +82,305 @@ func (p *Project) parse() {
 		}
 		p.Groups[s] = true
 	}
+	if p.Path == "" {
+		p.Path = p.Name
+	}
+	for i := range p.Project {
+		p.Project[i].parse()
+	}
 }
 
 type Remote struct {
-	Alias    string `xml:"alias,attr"`
-	Name     string `xml:"name,attr"`
-	Fetch    string `xml:"fetch,attr"`
-	Review   string `xml:"review,attr"`
-	Revision string `xml:"revision,attr"`
+	Alias      string       `xml:"alias,attr,omitempty"`
+	Name       string       `xml:"name,attr,omitempty"`
+	Fetch      string       `xml:"fetch,attr,omitempty"`
+	PushURL    string       `xml:"pushurl,attr,omitempty"`
+	Review     string       `xml:"review,attr,omitempty"`
+	Revision   string       `xml:"revision,attr,omitempty"`
+	Annotation []Annotation `xml:"annotation"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
 }
 
 type Default struct {
-	Revision   string `xml:"revision,attr"`
-	Remote     string `xml:"remote,attr"`
-	DestBranch string `xml:"dest-branch,attr"`
-	SyncJ      string `xml:"sync-j,attr"`
-	SyncC      string `xml:"sync-c,attr"`
-	SyncS      string `xml:"sync-s,attr"`
+	Revision   string `xml:"revision,attr,omitempty"`
+	Remote     string `xml:"remote,attr,omitempty"`
+	DestBranch string `xml:"dest-branch,attr,omitempty"`
+	Upstream   string `xml:"upstream,attr,omitempty"`
+	SyncJ      string `xml:"sync-j,attr,omitempty"`
+	SyncC      string `xml:"sync-c,attr,omitempty"`
+	SyncS      string `xml:"sync-s,attr,omitempty"`
+	SyncTags   string `xml:"sync-tags,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
+}
+
+type Include struct {
+	Name     string `xml:"name,attr,omitempty"`
+	Groups   string `xml:"groups,attr,omitempty"`
+	Revision string `xml:"revision,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
 }
 
 type ManifestServer struct {
-	URL string `xml:"url,attr"`
+	URL string `xml:"url,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
+}
+
+// Submanifest refers to another manifest to check out in a
+// subdirectory. Submanifests are parsed, but not mounted.
+type Submanifest struct {
+	Name          string `xml:"name,attr,omitempty"`
+	Remote        string `xml:"remote,attr,omitempty"`
+	Project       string `xml:"project,attr,omitempty"`
+	ManifestName  string `xml:"manifest-name,attr,omitempty"`
+	Revision      string `xml:"revision,attr,omitempty"`
+	Path          string `xml:"path,attr,omitempty"`
+	Groups        string `xml:"groups,attr,omitempty"`
+	DefaultGroups string `xml:"default-groups,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
 }
+
+type RemoveProject struct {
+	Name     string `xml:"name,attr,omitempty"`
+	Path     string `xml:"path,attr,omitempty"`
+	Optional string `xml:"optional,attr,omitempty"`
+	BaseRev  string `xml:"base-rev,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
+}
+
+// ExtendProject modifies the project with the same name (and path,
+// if set) defined elsewhere in the manifest.
+type ExtendProject struct {
+	Name       string       `xml:"name,attr,omitempty"`
+	Path       string       `xml:"path,attr,omitempty"`
+	DestPath   string       `xml:"dest-path,attr,omitempty"`
+	Groups     string       `xml:"groups,attr,omitempty"`
+	Revision   string       `xml:"revision,attr,omitempty"`
+	Remote     string       `xml:"remote,attr,omitempty"`
+	DestBranch string       `xml:"dest-branch,attr,omitempty"`
+	Upstream   string       `xml:"upstream,attr,omitempty"`
+	BaseRev    string       `xml:"base-rev,attr,omitempty"`
+	Annotation []Annotation `xml:"annotation"`
+	Copyfile   []Copyfile   `xml:"copyfile"`
+	Linkfile   []Linkfile   `xml:"linkfile"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
+}
+
+type RepoHooks struct {
+	InProject   string `xml:"in-project,attr,omitempty"`
+	EnabledList string `xml:"enabled-list,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
+}
+
+type Superproject struct {
+	Name     string `xml:"name,attr,omitempty"`
+	Remote   string `xml:"remote,attr,omitempty"`
+	Revision string `xml:"revision,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
+}
+
+type ContactInfo struct {
+	BugURL string `xml:"bugurl,attr,omitempty"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
+}
+
+// Manifest is a repo manifest; see
+// https://gerrit.googlesource.com/git-repo/+/HEAD/docs/manifest-format.md
 type Manifest struct {
-	Default Default   `xml:"default"`
-	Remote  Remote    `xml:"remote"`
-	Project []Project `xml:"project"`
+	XMLName        xml.Name        `xml:"manifest"`
+	Notice         string          `xml:"notice,omitempty"`
+	Remote         []Remote        `xml:"remote"`
+	Default        Default         `xml:"default"`
+	ManifestServer *ManifestServer `xml:"manifest-server"`
+	Submanifest    []Submanifest   `xml:"submanifest"`
+	RemoveProject  []RemoveProject `xml:"remove-project"`
+	Project        []Project       `xml:"project"`
+	ExtendProject  []ExtendProject `xml:"extend-project"`
+	RepoHooks      *RepoHooks      `xml:"repo-hooks"`
+	Superproject   *Superproject   `xml:"superproject"`
+	ContactInfo    *ContactInfo    `xml:"contactinfo"`
+	Include        []Include       `xml:"include"`
+
+	UnknownAttrs []xml.Attr `xml:",any,attr"`
+	Unknown      []Unknown  `xml:",any"`
+
+	// order lists the elements in document order, if that differs
+	// from the order of the fields, so it can be kept by Marshal
+	// and Effective.
+	order []element
+}
+
+// element refers to a child element of a manifest, by name and index
+// among the elements of that name. Unknown elements have no name.
+type element struct {
+	name  string
+	index int
+}
+
+// manifestElements lists the child elements of a manifest, with the
+// fields holding them, in the order of the fields.
+var manifestElements = []struct{ name, field string }{
+	{"notice", "Notice"},
+	{"remote", "Remote"},
+	{"default", "Default"},
+	{"manifest-server", "ManifestServer"},
+	{"submanifest", "Submanifest"},
+	{"remove-project", "RemoveProject"},
+	{"project", "Project"},
+	{"extend-project", "ExtendProject"},
+	{"repo-hooks", "RepoHooks"},
+	{"superproject", "Superproject"},
+	{"contactinfo", "ContactInfo"},
+	{"include", "Include"},
+	{"", "Unknown"},
+}
+
+// elementRank returns the position of the field for elements called
+// name in manifestElements.
+func elementRank(name string) int {
+	for i, e := range manifestElements[:len(manifestElements)-1] {
+		if e.name == name {
+			return i
+		}
+	}
+	return len(manifestElements) - 1
+}
+
+// isRepeated returns whether there can be several elements called
+// name.
+func isRepeated(name string) bool {
+	f, _ := reflect.TypeOf(Manifest{}).FieldByName(manifestElements[elementRank(name)].field)
+	return f.Type.Kind() == reflect.Slice
+}
+
+// elementValues returns the values of the elements called name.
+func (m *Manifest) elementValues(name string) []reflect.Value {
+	f := reflect.ValueOf(m).Elem().FieldByName(manifestElements[elementRank(name)].field)
+	switch f.Kind() {
+	case reflect.Slice:
+		vals := make([]reflect.Value, f.Len())
+		for i := range vals {
+			vals[i] = f.Index(i)
+		}
+		return vals
+	case reflect.Ptr:
+		if f.IsNil() {
+			return nil
+		}
+	case reflect.String:
+		if f.Len() == 0 {
+			return nil
+		}
+	}
+	return []reflect.Value{f}
+}
+
+// elements returns all child elements of the manifest, in document
+// order. Elements that were added after parsing follow, in the order
+// of the fields.
+func (m *Manifest) elements() []element {
+	var all []element
+	seen := map[element]bool{}
+	for _, e := range m.order {
+		if e.index < len(m.elementValues(e.name)) && !seen[e] {
+			all = append(all, e)
+			seen[e] = true
+		}
+	}
+	for _, f := range manifestElements {
+		for i := range m.elementValues(f.name) {
+			if e := (element{f.name, i}); !seen[e] {
+				all = append(all, e)
+			}
+		}
+	}
+	return all
+}
+
+// parseOrder returns the child elements of the manifest in contents,
+// in document order, or nil if they are in the order of the fields.
+func parseOrder(contents []byte) ([]element, error) {
+	d := xml.NewDecoder(bytes.NewReader(contents))
+	var order []element
+	counts := map[string]int{}
+	inOrder := true
+	last := 0
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth != 2 {
+				continue
+			}
+			rank := elementRank(t.Name.Local)
+			name := manifestElements[rank].name
+			if err := d.Skip(); err != nil {
+				return nil, err
+			}
+			depth--
+			if !isRepeated(name) && counts[name] > 0 {
+				// Repeating a single element updates it.
+				continue
+			}
+			order = append(order, element{name, counts[name]})
+			counts[name]++
+			if rank < last {
+				inOrder = false
+			}
+			last = rank
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if inOrder {
+		return nil, nil
+	}
+	return order, nil
+}
+
+// ProjectRemote returns the name of the remote for the project.
+func (m *Manifest) ProjectRemote(p *Project) string {
+	if p.Remote != "" {
+		return p.Remote
+	}
+	if m.Default.Remote != "" {
+		return m.Default.Remote
+	}
+	if len(m.Remote) == 1 {
+		return m.Remote[0].Name
+	}
+	return ""
+}
+
+// ProjectRevision returns the revision to use for the project, or ""
+// if neither the project, its remote nor the default specify one.
+func (m *Manifest) ProjectRevision(p *Project) string {
+	if p.Revision != "" {
+		return p.Revision
+	}
+	name := m.ProjectRemote(p)
+	for _, r := range m.Remote {
+		if r.Name == name && r.Revision != "" {
+			return r.Revision
+		}
+	}
+	return m.Default.Revision
 }
 
 func Parse(contents []byte) (*Manifest, error) {
@@ -85,13 +392,246 @@ func Parse(contents []byte) (*Manifest, error) {
 	for i := range m.Project {
 		m.Project[i].parse()
 	}
+	order, err := parseOrder(contents)
+	if err != nil {
+		return nil, err
+	}
+	m.order = order
 	return &m, nil
 }
 
+// Marshal serializes the manifest as XML. Elements and attributes
+// that were not understood by Parse are written back, and elements
+// keep their order, so parse/marshal round trips do not lose
+// information.
+func (m *Manifest) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := m.encode(enc); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func (m *Manifest) encode(enc *xml.Encoder) error {
+	if m.order == nil {
+		return enc.Encode(m)
+	}
+
+	start := xml.StartElement{Name: m.XMLName, Attr: m.UnknownAttrs}
+	if start.Name.Local == "" {
+		start.Name.Local = "manifest"
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, e := range m.elements() {
+		v := m.elementValues(e.name)[e.index].Interface()
+		var err error
+		if e.name == "" {
+			err = enc.Encode(v)
+		} else {
+			err = enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: e.name}})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// Load parses the manifest called name, and merges in the manifests
+// it includes. The read function returns the contents of a
+// manifest, given its name. The result is the effective manifest;
+// see Manifest.Effective.
+func Load(name string, read func(name string) ([]byte, error)) (*Manifest, error) {
+	m, err := load(name, read, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+	return m.Effective(), nil
+}
+
+func load(name string, read func(name string) ([]byte, error), seen map[string]bool) (*Manifest, error) {
+	if seen[name] {
+		return nil, fmt.Errorf("manifest: include cycle at %q", name)
+	}
+	seen[name] = true
+	defer delete(seen, name)
+
+	content, err := read(name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("manifest %q: %v", name, err)
+	}
+
+	// The elements of included manifests take the place of the
+	// include element.
+	var order []element
+	for _, e := range m.elements() {
+		if e.name != "include" {
+			order = append(order, e)
+			continue
+		}
+		sub, err := load(m.Include[e.index].Name, read, seen)
+		if err != nil {
+			return nil, err
+		}
+		for _, se := range sub.elements() {
+			if isRepeated(se.name) {
+				n := len(m.elementValues(se.name))
+				order = append(order, element{se.name, n + se.index})
+			}
+		}
+		m.merge(sub)
+	}
+	m.Include = nil
+	m.order = order
+	return m, nil
+}
+
+// merge adds the contents of an included manifest.
+func (m *Manifest) merge(inc *Manifest) {
+	if m.Notice == "" {
+		m.Notice = inc.Notice
+	}
+	m.Remote = append(m.Remote, inc.Remote...)
+	if !reflect.DeepEqual(inc.Default, Default{}) {
+		m.Default = inc.Default
+	}
+	if m.ManifestServer == nil {
+		m.ManifestServer = inc.ManifestServer
+	}
+	m.Submanifest = append(m.Submanifest, inc.Submanifest...)
+	m.RemoveProject = append(m.RemoveProject, inc.RemoveProject...)
+	m.Project = append(m.Project, inc.Project...)
+	m.ExtendProject = append(m.ExtendProject, inc.ExtendProject...)
+	if m.RepoHooks == nil {
+		m.RepoHooks = inc.RepoHooks
+	}
+	if m.Superproject == nil {
+		m.Superproject = inc.Superproject
+	}
+	if m.ContactInfo == nil {
+		m.ContactInfo = inc.ContactInfo
+	}
+	m.Unknown = append(m.Unknown, inc.Unknown...)
+}
+
+// Effective returns the manifest as repo would check it out:
+// subprojects are flattened into the project list, with their name
+// and path joined to those of their parent, and extend-project and
+// remove-project elements are applied in document order, to the
+// projects that precede them. The receiver is not modified.
+func (m *Manifest) Effective() *Manifest {
+	e := *m
+	e.Project = nil
+	e.ExtendProject = nil
+	e.RemoveProject = nil
+	e.order = nil
+
+	var add func(parent *Project, p Project)
+	add = func(parent *Project, p Project) {
+		subs := p.Project
+		p.Project = nil
+		if parent != nil {
+			p.Name = path.Join(parent.Name, p.Name)
+			p.Path = path.Join(parent.Path, p.Path)
+			p.Parent = parent
+		}
+		e.Project = append(e.Project, p)
+		for _, sub := range subs {
+			add(&p, sub)
+		}
+	}
+	for _, el := range m.elements() {
+		switch el.name {
+		case "project":
+			add(nil, m.Project[el.index])
+		case "extend-project":
+			e.extend(&m.ExtendProject[el.index])
+		case "remove-project":
+			e.remove(&m.RemoveProject[el.index])
+		}
+	}
+	return &e
+}
+
+// extend applies an extend-project element to the projects.
+func (m *Manifest) extend(x *ExtendProject) {
+	var matches []*Project
+	for i := range m.Project {
+		p := &m.Project[i]
+		if p.Name == x.Name && (x.Path == "" || p.Path == x.Path) {
+			matches = append(matches, p)
+		}
+	}
+	for _, p := range matches {
+		if x.Groups != "" {
+			if p.GroupsString != "" {
+				p.GroupsString += ","
+			}
+			p.GroupsString += x.Groups
+			p.Groups = nil
+			p.parse()
+		}
+		if x.Revision != "" {
+			p.Revision = x.Revision
+		}
+		if x.Remote != "" {
+			p.Remote = x.Remote
+		}
+		if x.DestBranch != "" {
+			p.DestBranch = x.DestBranch
+		}
+		if x.Upstream != "" {
+			p.Upstream = x.Upstream
+		}
+		// Like repo, only move a project that is identified
+		// unambiguously.
+		if x.DestPath != "" && len(matches) == 1 {
+			p.Path = x.DestPath
+		}
+		p.Annotation = append(append([]Annotation{}, p.Annotation...), x.Annotation...)
+		p.Copyfile = append(append([]Copyfile{}, p.Copyfile...), x.Copyfile...)
+		p.Linkfile = append(append([]Linkfile{}, p.Linkfile...), x.Linkfile...)
+	}
+}
+
+// remove applies a remove-project element to the projects.
+func (m *Manifest) remove(r *RemoveProject) {
+	if r.Name == "" && r.Path == "" {
+		return
+	}
+	var kept []Project
+	for _, p := range m.Project {
+		if (r.Name == "" || p.Name == r.Name) && (r.Path == "" || p.Path == r.Path) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	m.Project = kept
+}
+
+// ParseFile reads a manifest from disk. Included manifests are read
+// from the directory containing the manifest, after resolving
+// symlinks.
 func ParseFile(name string) (*Manifest, error) {
-	content, err := ioutil.ReadFile(name)
+	resolved, err := filepath.EvalSymlinks(name)
 	if err != nil {
 		return nil, err
 	}
-	return Parse(content)
+	dir := filepath.Dir(resolved)
+	return Load(filepath.Base(resolved), func(n string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(dir, n))
+	})
 }
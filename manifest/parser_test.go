@@ -1,7 +1,10 @@
 package manifest
 
 import (
+	"encoding/xml"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -29,10 +32,13 @@ func TestBasic(t *testing.T) {
 	}
 
 	want := &Manifest{
-		Remote: Remote{
-			Name:   "aosp",
-			Fetch:  "..",
-			Review: "https://android-review.googlesource.com/",
+		XMLName: xml.Name{Local: "manifest"},
+		Remote: []Remote{
+			{
+				Name:   "aosp",
+				Fetch:  "..",
+				Review: "https://android-review.googlesource.com/",
+			},
 		},
 		Default: Default{
 			Revision: "master",
@@ -77,3 +83,351 @@ func TestBasic(t *testing.T) {
 		t.Errorf("got %v, want %v", manifest, want)
 	}
 }
+
+func TestGroups(t *testing.T) {
+	p := Project{
+		Path:         "build/soong",
+		Name:         "platform/build/soong",
+		GroupsString: "pdk,tradefed",
+	}
+	p.parse()
+	notDefault := Project{
+		Path:         "device/linux",
+		Name:         "device/linux",
+		GroupsString: "notdefault,platform-linux",
+	}
+	notDefault.parse()
+
+	for _, tc := range []struct {
+		spec             string
+		want, wantNotDef bool
+	}{
+		{"", true, false},
+		{"default", true, false},
+		{"all", true, true},
+		{"default,-notdefault,platform-linux", true, true},
+		{"platform-linux,-notdefault", false, false},
+		{"default,platform-linux", true, true},
+		{"pdk", true, false},
+		{"all,-pdk", false, true},
+		{"name:device/linux", false, true},
+		{"path:build/soong", true, false},
+		{"default path:device/linux", true, true},
+	} {
+		groups := ParseGroups(tc.spec)
+		if got := p.MatchGroups(groups); got != tc.want {
+			t.Errorf("%q: MatchGroups(%q) = %v, want %v", p.Name, tc.spec, got, tc.want)
+		}
+		if got := notDefault.MatchGroups(groups); got != tc.wantNotDef {
+			t.Errorf("%q: MatchGroups(%q) = %v, want %v", notDefault.Name, tc.spec, got, tc.wantNotDef)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	m, err := Parse([]byte(aospManifest))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if err := Validate(m); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	bad := `<manifest>
+  <remote name="aosp" fetch=".." />
+  <default remote="aosp" />
+  <project path="build" name="platform/build" revision="master">
+    <copyfile src="core/root.mk" dest="Makefile" />
+    <linkfile src="../escape" dest="build/x" />
+  </project>
+  <project path="build" name="platform/build2" revision="master" />
+  <project path="../out" name="out" revision="master" />
+  <project path="Makefile/sub" name="sub" revision="master" />
+  <project path="norev" name="norev" />
+  <project path="other" name="other" remote="github" revision="master" />
+  <project path="again" name="other" revision="master" />
+</manifest>`
+	m, err = Parse([]byte(bad))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	err = Validate(m)
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("got %v, want *ValidationError", err)
+	}
+
+	// linkfile source, destination inside project, duplicate path,
+	// path outside tree, project inside file, no revision,
+	// unknown remote, duplicate name.
+	if len(verr.Errors) != 8 {
+		t.Errorf("got %d errors, want 8: %v", len(verr.Errors), verr)
+	}
+}
+
+var extendedManifest = `<?xml version="1.0" encoding="UTF-8"?>
+<manifest>
+  <notice>Some notice.</notice>
+  <remote name="aosp" fetch=".." custom="value" />
+  <default revision="master" remote="aosp" />
+  <manifest-server url="https://example.com/manifest" />
+  <project path="build" name="platform/build" groups="pdk" x-extra="1">
+    <copyfile src="core/root.mk" dest="Makefile" />
+    <annotation name="key" value="value" keep="true" />
+  </project>
+  <remove-project name="platform/unused" />
+  <repo-hooks in-project="platform/tools/repohooks" enabled-list="pre-upload" />
+</manifest>`
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, in := range []string{aospManifest, extendedManifest} {
+		m, err := Parse([]byte(in))
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+
+		out, err := m.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+
+		roundTrip, err := Parse(out)
+		if err != nil {
+			t.Fatalf("Parse(Marshal): %v\n%s", err, out)
+		}
+
+		if !reflect.DeepEqual(m, roundTrip) {
+			t.Errorf("round trip changed manifest: got %v, want %v\n%s", roundTrip, m, out)
+		}
+	}
+
+	m, err := Parse([]byte(extendedManifest))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	out, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	for _, want := range []string{
+		"<notice>Some notice.</notice>",
+		`custom="value"`,
+		`x-extra="1"`,
+		`<annotation name="key" value="value" keep="true">`,
+		`<remove-project name="platform/unused">`,
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Index(string(out), "<remove-project") < strings.Index(string(out), "<project") {
+		t.Errorf("remove-project moved before project:\n%s", out)
+	}
+}
+
+func TestEffectiveOrder(t *testing.T) {
+	m, err := Parse([]byte(`<manifest>
+  <default revision="master" />
+  <project path="build" name="platform/build" />
+  <project path="art" name="platform/art" />
+  <remove-project name="platform/build" />
+  <project path="build" name="platform/build" revision="stable" />
+  <extend-project name="platform/art" dest-path="moved/art" />
+</manifest>`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	e := m.Effective()
+	if len(e.Project) != 2 {
+		t.Fatalf("got %v, want 2 projects", e.Project)
+	}
+	if p := e.Project[0]; p.Path != "moved/art" {
+		t.Errorf("extend-project without path: got path %q, want moved/art", p.Path)
+	}
+	if p := e.Project[1]; p.Name != "platform/build" || p.Revision != "stable" {
+		t.Errorf("got %v, want the re-added platform/build", p)
+	}
+}
+
+func TestLoadIncludes(t *testing.T) {
+	files := map[string]string{
+		"default.xml": `<manifest>
+  <remote name="aosp" fetch=".." />
+  <default revision="master" remote="aosp" />
+  <include name="extra.xml" />
+  <project path="build" name="platform/build" />
+</manifest>`,
+		"extra.xml": `<manifest>
+  <remote name="github" fetch="https://github.com" />
+  <project path="external/gitfs" name="hanwen/gitfs" remote="github" />
+</manifest>`,
+		"loop.xml": `<manifest><include name="loop.xml" /></manifest>`,
+	}
+	read := func(name string) ([]byte, error) {
+		c, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("not found: %q", name)
+		}
+		return []byte(c), nil
+	}
+
+	m, err := Load("default.xml", read)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(m.Remote) != 2 || len(m.Project) != 2 || len(m.Include) != 0 {
+		t.Errorf("got %d remotes, %d projects, %d includes; want 2, 2, 0",
+			len(m.Remote), len(m.Project), len(m.Include))
+	}
+	if m.Default.Revision != "master" {
+		t.Errorf("got default revision %q, want master", m.Default.Revision)
+	}
+	if err := Validate(m); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+
+	if _, err := Load("loop.xml", read); err == nil {
+		t.Errorf("Load accepted include cycle")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, err := Parse([]byte(`<manifest>
+  <default revision="master" />
+  <project path="build" name="platform/build" />
+  <project path="art" name="platform/art" />
+  <project path="old" name="platform/old" />
+  <project path="bionic" name="platform/bionic" />
+</manifest>`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	b, err := Parse([]byte(`<manifest>
+  <default revision="master" />
+  <project path="build" name="platform/build" />
+  <project path="art" name="platform/art" revision="release" />
+  <project path="libc" name="platform/bionic" revision="v2" />
+  <project path="new" name="platform/new" />
+</manifest>`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	c := Diff(a, b)
+	var names []string
+	for _, p := range c.Added {
+		names = append(names, "added:"+p.Name)
+	}
+	for _, p := range c.Removed {
+		names = append(names, "removed:"+p.Name)
+	}
+	for _, ch := range c.Moved {
+		names = append(names, "moved:"+ch.New.Name)
+	}
+	for _, ch := range c.Repinned {
+		names = append(names, "repinned:"+ch.New.Name+":"+ch.OldRevision+":"+ch.NewRevision)
+	}
+	want := []string{
+		"added:platform/new",
+		"removed:platform/old",
+		"moved:platform/bionic",
+		"repinned:platform/art:master:release",
+		"repinned:platform/bionic:master:v2",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	if c := Diff(a, a); !c.Empty() {
+		t.Errorf("Diff(a, a) = %v, want empty", c)
+	}
+}
+
+// realWorldManifest is modeled on the AOSP and ChromiumOS manifests,
+// and uses every element of the manifest format.
+var realWorldManifest = `<?xml version="1.0" encoding="UTF-8"?>
+<manifest>
+  <notice>Your sources have been sync'd successfully.</notice>
+  <remote name="aosp" fetch=".." review="https://android-review.googlesource.com/" revision="main">
+    <annotation name="remote-key" value="remote-value" />
+  </remote>
+  <remote name="cros" alias="origin" fetch="https://chromium.googlesource.com" pushurl="sso://chromium" />
+  <default revision="main" remote="aosp" sync-j="4" sync-tags="false" upstream="main" />
+  <manifest-server url="http://android-smartsync.corp.example.com/manifestserver" />
+  <submanifest name="vendor" project="vendor/manifest" manifest-name="vendor.xml" path="vendor" />
+  <project path="build/make" name="platform/build" groups="pdk,sysui-studio" clone-depth="1">
+    <annotation name="branch" value="main" keep="false" />
+    <copyfile src="core/root.mk" dest="Makefile" />
+    <linkfile src="CleanSpec.mk" dest="build/CleanSpec.mk" />
+    <linkfile src="envsetup.sh" dest="build/envsetup.sh" />
+  </project>
+  <project path="build/soong" name="platform/build/soong" groups="pdk,tradefed">
+    <linkfile src="root.bp" dest="Android.bp" />
+  </project>
+  <project path="chromite" name="chromiumos/chromite" remote="cros" revision="refs/heads/release-R120" sync-c="true">
+    <project path="third_party/pylint" name="pylint" groups="notdefault" />
+  </project>
+  <project path="unused" name="platform/unused" />
+  <remove-project name="platform/unused" />
+  <extend-project name="platform/build/soong" groups="extra" revision="stable">
+    <linkfile src="bootstrap.bash" dest="bootstrap.bash" />
+  </extend-project>
+  <repo-hooks in-project="platform/tools/repohooks" enabled-list="pre-upload" />
+  <superproject name="platform/superproject" remote="aosp" revision="main" />
+  <contactinfo bugurl="https://issuetracker.google.com/issues/new?component=123" />
+</manifest>`
+
+func TestRealWorld(t *testing.T) {
+	m, err := Parse([]byte(realWorldManifest))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	if m.ManifestServer == nil || m.RepoHooks == nil || m.Superproject == nil || m.ContactInfo == nil {
+		t.Errorf("missing singleton elements: %v", m)
+	}
+	if len(m.Unknown) > 0 {
+		t.Errorf("got unknown elements %v", m.Unknown)
+	}
+	if got := m.Project[0].Annotation; len(got) != 1 || got[0].Value != "main" {
+		t.Errorf("got annotations %v", got)
+	}
+
+	out, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	roundTrip, err := Parse(out)
+	if err != nil {
+		t.Fatalf("Parse(Marshal): %v", err)
+	}
+	if !reflect.DeepEqual(m, roundTrip) {
+		t.Errorf("round trip changed manifest:\n%s", out)
+	}
+
+	e := m.Effective()
+	byPath := map[string]Project{}
+	for _, p := range e.Project {
+		byPath[p.Path] = p
+	}
+	if len(e.Project) != 4 || len(e.ExtendProject) != 0 || len(e.RemoveProject) != 0 {
+		t.Errorf("got %v, want 4 projects without extend/remove", e.Project)
+	}
+	if p, ok := byPath["chromite/third_party/pylint"]; !ok || p.Name != "chromiumos/chromite/pylint" {
+		t.Errorf("subproject: got %v", byPath)
+	}
+	soong := byPath["build/soong"]
+	if soong.Revision != "stable" || !soong.Groups["extra"] || !soong.Groups["pdk"] || len(soong.Linkfile) != 2 {
+		t.Errorf("extend-project not applied: %v", soong)
+	}
+	if _, ok := byPath["unused"]; ok {
+		t.Errorf("remove-project not applied")
+	}
+	if len(m.Project) != 4 || len(m.Project[1].Linkfile) != 1 {
+		t.Errorf("Effective modified its receiver")
+	}
+	if err := Validate(e); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package manifest
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ProjectError is a problem with a single project of a manifest.
+type ProjectError struct {
+	Name string
+	Path string
+	Err  error
+}
+
+func (e *ProjectError) Error() string {
+	return fmt.Sprintf("project %q (path %q): %v", e.Name, e.Path, e.Err)
+}
+
+// ValidationError lists all the problems found in a manifest.
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	var msgs []string
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("manifest has %d problem(s):\n%s", len(e.Errors), strings.Join(msgs, "\n"))
+}
+
+// escapes returns whether the relative path p points outside of the
+// tree that contains it.
+func escapes(p string) bool {
+	clean := filepath.Clean(p)
+	return p == "" || filepath.IsAbs(p) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../")
+}
+
+func parents(p string) []string {
+	var r []string
+	for {
+		p = filepath.Dir(p)
+		if p == "." || p == "/" {
+			break
+		}
+		r = append(r, p)
+	}
+	return r
+}
+
+// Validate checks that the projects of the manifest can be laid out
+// in a single tree: names and paths must be unique and paths must
+// stay inside the tree, copyfile and linkfile destinations may not
+// collide with each other or with projects, and every project must
+// have a known remote and a revision. If there are problems, a
+// *ValidationError listing all of them is returned.
+func Validate(m *Manifest) error {
+	var errs []error
+
+	remotes := map[string]bool{}
+	for _, r := range m.Remote {
+		if remotes[r.Name] {
+			errs = append(errs, fmt.Errorf("duplicate remote %q", r.Name))
+		}
+		remotes[r.Name] = true
+	}
+
+	// name => path of the project.
+	names := map[string]string{}
+	// path => description of what is there.
+	projects := map[string]string{}
+	files := map[string]string{}
+	// directories implied by projects and files.
+	dirs := map[string]bool{}
+
+	for i := range m.Project {
+		p := &m.Project[i]
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, &ProjectError{p.Name, p.Path, fmt.Errorf(format, args...)})
+		}
+
+		if p.Name == "" {
+			fail("missing name")
+		} else if other, ok := names[p.Name]; ok {
+			fail("duplicate name, also used at path %q", other)
+		} else {
+			names[p.Name] = p.Path
+		}
+		if remote := m.ProjectRemote(p); remote != "" && !remotes[remote] {
+			fail("unknown remote %q", remote)
+		}
+		if m.ProjectRevision(p) == "" {
+			fail("no revision")
+		}
+
+		if escapes(p.Path) {
+			fail("path is outside the tree")
+			continue
+		}
+		path := filepath.Clean(p.Path)
+		if other, ok := projects[path]; ok {
+			fail("duplicate path, also used by %s", other)
+		} else {
+			projects[path] = fmt.Sprintf("project %q", p.Name)
+		}
+		for _, d := range parents(path) {
+			dirs[d] = true
+		}
+
+		var dests []string
+		for _, c := range p.Copyfile {
+			if escapes(c.Src) {
+				fail("copyfile source %q is outside the project", c.Src)
+			}
+			dests = append(dests, c.Dest)
+		}
+		for _, l := range p.Linkfile {
+			if escapes(l.Src) {
+				fail("linkfile source %q is outside the project", l.Src)
+			}
+			dests = append(dests, l.Dest)
+		}
+		for _, dest := range dests {
+			if escapes(dest) {
+				fail("destination %q is outside the tree", dest)
+				continue
+			}
+			clean := filepath.Clean(dest)
+			if other, ok := files[clean]; ok {
+				fail("destination %q also used by %s", dest, other)
+				continue
+			}
+			files[clean] = fmt.Sprintf("a file of project %q", p.Name)
+			for _, d := range parents(clean) {
+				dirs[d] = true
+			}
+		}
+	}
+
+	// Projects may nest inside other projects, but files may not
+	// overlap with projects, nor contain other paths.
+	var fileNames []string
+	for f := range files {
+		fileNames = append(fileNames, f)
+	}
+	sort.Strings(fileNames)
+	for _, f := range fileNames {
+		what := files[f]
+		if other, ok := projects[f]; ok {
+			errs = append(errs, fmt.Errorf("destination %q of %s is used by %s", f, what, other))
+		} else if dirs[f] {
+			errs = append(errs, fmt.Errorf("destination %q of %s has other paths nested inside it", f, what))
+		}
+		for _, d := range parents(f) {
+			if other, ok := projects[d]; ok {
+				errs = append(errs, fmt.Errorf("destination %q of %s is inside %s", f, what, other))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{errs}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hanwen/gitfs/fs"
+	"github.com/hanwen/gitfs/manifest"
+	git "github.com/libgit2/git2go"
+)
+
+// readManifestArg reads a manifest file, or the pinned manifest of a
+// mounted manifest FS if name is a directory.
+func readManifestArg(name string) (*manifest.Manifest, error) {
+	if fi, err := os.Stat(name); err == nil && fi.IsDir() {
+		name = filepath.Join(name, fs.PinnedManifestPath)
+	}
+	return manifest.ParseFile(name)
+}
+
+// manifestDiffCmd implements "gitfs manifest-diff A B".
+func manifestDiffCmd(args []string) {
+	flags := flag.NewFlagSet("manifest-diff", flag.ExitOnError)
+	logRoot := flags.String("log", "", "if set, list the commits between the revisions of repinned projects, using the repositories under this directory (eg. a .repo directory).")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		log.Fatalf("usage: %s manifest-diff [-log REPO] A.xml|MOUNT B.xml|MOUNT", os.Args[0])
+	}
+
+	a, err := readManifestArg(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("ParseFile(%q): %v", flags.Arg(0), err)
+	}
+	b, err := readManifestArg(flags.Arg(1))
+	if err != nil {
+		log.Fatalf("ParseFile(%q): %v", flags.Arg(1), err)
+	}
+
+	changes := manifest.Diff(a, b)
+	if err := changes.Write(os.Stdout); err != nil {
+		log.Fatalf("Write: %v", err)
+	}
+	if *logRoot == "" {
+		return
+	}
+
+	locator, err := fs.NewProjectLocator(*logRoot)
+	if err != nil {
+		log.Fatalf("NewProjectLocator: %v", err)
+	}
+	for _, ch := range changes.Repinned {
+		fmt.Printf("\n%s (%s..%s):\n", ch.New.Name, ch.OldRevision, ch.NewRevision)
+		if err := printProjectLog(locator, a, b, &ch); err != nil {
+			fmt.Printf("  %v\n", err)
+		}
+	}
+}
+
+// printProjectLog prints the commits that are in the new revision of
+// a repinned project, but not in the old one.
+func printProjectLog(locator fs.ProjectLocator, a, b *manifest.Manifest, ch *manifest.ProjectChange) error {
+	dir, err := locator.Locate(&ch.New)
+	if err != nil {
+		return err
+	}
+	repo, err := git.OpenRepository(dir)
+	if err != nil {
+		return err
+	}
+	defer repo.Free()
+
+	resolve := func(treeish string) (*git.Oid, error) {
+		obj, err := repo.RevparseSingle(treeish)
+		if err != nil {
+			return nil, err
+		}
+		defer obj.Free()
+		return obj.Id().Copy(), nil
+	}
+	from, err := resolve(fs.ProjectTreeish(a, &ch.Old))
+	if err != nil {
+		return err
+	}
+	to, err := resolve(fs.ProjectTreeish(b, &ch.New))
+	if err != nil {
+		return err
+	}
+
+	walk, err := repo.Walk()
+	if err != nil {
+		return err
+	}
+	defer walk.Free()
+	walk.Sorting(git.SortTopological)
+	if err := walk.Push(to); err != nil {
+		return err
+	}
+	if err := walk.Hide(from); err != nil {
+		return err
+	}
+	return walk.Iterate(func(c *git.Commit) bool {
+		fmt.Printf("  %.12s %s\n", c.Id().String(), c.Summary())
+		return true
+	})
+}
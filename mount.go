@@ -0,0 +1,354 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/gitfs/fs"
+	"github.com/hanwen/gitfs/manifest"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	git "github.com/libgit2/git2go"
+)
+
+// fsType is the filesystem type gitfs mounts show up with in
+// /proc/mounts, as "fuse.gitfs".
+const fsType = "gitfs"
+
+// mountCmd implements "gitfs mount MOUNT".
+func mountCmd(args []string) {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	debug := flags.Bool("debug", false, "print FUSE debug data")
+	lazy := flags.Bool("lazy", true, "only read contents for reads")
+	disk := flags.Bool("disk", false, "don't use intermediate files")
+	prefetch := flags.Int("prefetch", 4, "blobs to load concurrently per tree when prefetching the small files of a directory that is listed or read; 0 disables prefetching.")
+	objectCacheMB := flags.Int64("object_cache_mb", fs.DefaultObjectCacheSize>>20, "memory per repository for caching small blobs, in megabytes.")
+	gitRepo := flags.String("git_repo", "", "if set, mount a single repository.")
+	repo := flags.String("repo", "", "if set, mount a single manifest from repo repository.")
+	groups := flags.String("groups", "default", "manifest groups to mount, eg. \"default,-notdefault,platform-linux\".")
+	strict := flags.Bool("strict", false, "fail if any manifest project cannot be loaded.")
+	layout := flags.String("layout", "", "comma separated project layouts to try (projects, subprojects, project-objects, mirror). Default: all of them.")
+	manifestRepo := flags.String("manifest_repo", "", "if set, read the -repo manifest from git, given as REPO-DIR:TREEISH.")
+	manifestName := flags.String("manifest_name", "default.xml", "manifest file to read from -manifest_repo.")
+	track := flags.Duration("track", 0, "if set, poll -manifest_repo at this interval, and follow manifest updates.")
+	control := flags.String("control", "", "serve the control API on this Unix domain socket. Default: one named after MOUNT in $XDG_RUNTIME_DIR/gitfs (or $TMPDIR/gitfs-UID), where \"gitfs warm MOUNT\" and others find it.")
+	daemon := flags.Bool("daemon", false, "run in the background once the filesystem is mounted.")
+	pidfile := flags.String("pidfile", "", "if set, write the process ID to this file once mounted.")
+	metricsAddr := flags.String("metrics_addr", "", "if set, serve metrics in Prometheus format on http://ADDR/metrics, eg. localhost:9101.")
+	logLevel := flags.String("log_level", "info", "lowest level to log: debug, info, warning or error.")
+	logJSON := flags.Bool("log_json", false, "log JSON objects, one per line.")
+	logFile := flags.String("log_file", "", "if set, append the log to this file instead of writing it to stderr. With -daemon, stderr is detached once mounted, and goes to this file, or is discarded.")
+	logDebugMount := flags.String("log_debug_mount", "", "comma separated mount paths (patterns, eg. \"platform/*\") to log FUSE operations for, at debug level.")
+	hermetic := flags.Bool("hermetic", false, "support per-process allowlists (see \"gitfs restrict\"). This disables caching of lookups in the kernel.")
+	readyFd := flags.Int("ready_fd", 0, "if set, write \"ready\" to this file descriptor and close it once mounted. Cannot be used with -daemon.")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		log.Fatalf("usage: %s mount [FLAGS] MOUNT", os.Args[0])
+	}
+	if *daemon {
+		if *readyFd != 0 {
+			log.Fatalf("-ready_fd cannot be used with -daemon")
+		}
+		*readyFd = daemonize(args)
+	}
+
+	level, err := fs.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("-log_level: %v", err)
+	}
+	logOpts := fs.LoggerOptions{Level: level, JSON: *logJSON}
+	if *logDebugMount != "" {
+		logOpts.DebugMounts = strings.Split(*logDebugMount, ",")
+		logOpts.Level = fs.LevelDebug
+	}
+	logOut := os.Stderr
+	if *logFile != "" {
+		logOut, err = os.OpenFile(*logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatalf("-log_file: %v", err)
+		}
+	}
+	logger := fs.NewLogger(logOut, &logOpts)
+	fs.SetLogger(logger)
+
+	tempDir, err := ioutil.TempDir("", "gitfs")
+	if err != nil {
+		log.Fatalf("TempDir: %v", err)
+	}
+	cleanup := func() error {
+		return os.RemoveAll(tempDir)
+	}
+	fatalf := func(format string, args ...interface{}) {
+		cleanup()
+		log.Fatalf(format, args...)
+	}
+
+	mntDir := flags.Arg(0)
+	opts := fs.GitFSOptions{
+		Lazy:    *lazy,
+		Disk:    *disk,
+		TempDir: tempDir,
+		Tracer:  fs.NewTracer(),
+		Metrics: fs.NewMetrics(),
+
+		ObjectCacheSize: *objectCacheMB << 20,
+		PrefetchWorkers: *prefetch,
+	}
+	var root nodefs.Node
+	source := fsType
+
+	// reload rereads the configuration, if supported.
+	var reload func() error
+	ctl := fs.NewControlServer()
+	ctl.HandleDiskCache(tempDir)
+	ctl.HandleTracer(opts.Tracer)
+	if *hermetic {
+		opts.Allowlist = fs.NewAllowlist()
+		ctl.HandleAllowlist(opts.Allowlist)
+	}
+	if *repo != "" {
+		source = *repo
+		var manifestGit *git.Repository
+		var manifestTreeish string
+		readManifest := func() (*manifest.Manifest, *git.Oid, error) {
+			m, err := manifest.ParseFile(filepath.Join(*repo, "manifest.xml"))
+			return m, nil, err
+		}
+		if *manifestRepo != "" {
+			components := strings.Split(*manifestRepo, ":")
+			if len(components) != 2 {
+				fatalf("-manifest_repo must have format REPO-DIR:TREEISH")
+			}
+			manifestTreeish = components[1]
+			manifestGit, err = git.OpenRepository(components[0])
+			if err != nil {
+				fatalf("OpenRepository(%q): %v", components[0], err)
+			}
+			readManifest = func() (*manifest.Manifest, *git.Oid, error) {
+				return fs.ReadGitManifest(manifestGit, manifestTreeish, *manifestName)
+			}
+		}
+		m, manifestId, err := readManifest()
+		if err != nil {
+			fatalf("reading manifest: %v", err)
+		}
+
+		var layouts []string
+		if *layout != "" {
+			layouts = strings.Split(*layout, ",")
+		}
+		locator, err := fs.NewProjectLocator(*repo, layouts...)
+		if err != nil {
+			fatalf("NewProjectLocator: %v", err)
+		}
+
+		manifestOpts := fs.ManifestFSOptions{
+			Groups:  manifest.ParseGroups(*groups),
+			Strict:  *strict,
+			Locator: locator,
+		}
+		mfs, err := fs.NewManifestFS(m, *repo, &manifestOpts, &opts)
+		if err != nil {
+			fatalf("NewManifestFS: %v", err)
+		}
+		root = mfs
+		ctl.HandleMounts(mfs)
+		countMounts(opts.Metrics, mfs)
+
+		reload = func() error {
+			m, _, err := readManifest()
+			if err != nil {
+				return err
+			}
+			return mfs.Update(m)
+		}
+		ctl.HandleReload(reload)
+
+		if manifestGit != nil && *track > 0 {
+			go fs.TrackGitManifest(mfs, manifestGit, manifestTreeish, *manifestName, manifestId, *track)
+		}
+	} else if *gitRepo != "" {
+		source = *gitRepo
+		var err error
+		root, err = fs.NewGitFSRoot(*gitRepo, &opts)
+		if err != nil {
+			fatalf("NewGitFSRoot: %v", err)
+		}
+	} else {
+		multi := fs.NewMultiGitFSRoot(&opts)
+		ctl.HandleMultiGitFS(multi)
+		countMounts(opts.Metrics, multi)
+		root = multi
+	}
+
+	nodefsOpts := opts.NodefsOptions()
+	if *repo != "" || *gitRepo == "" {
+		// Only trees look up their known children; the multi
+		// and manifest roots leave that to nodefs.
+		nodefsOpts.LookupKnownChildren = false
+	}
+	conn := nodefs.NewFileSystemConnector(root, nodefsOpts)
+	absMnt, err := filepath.Abs(mntDir)
+	if err != nil {
+		fatalf("Abs: %v", err)
+	}
+	ctl.HandleWarm(conn, root, absMnt, &opts)
+	if *metricsAddr != "" {
+		l, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			fatalf("Listen: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			opts.Metrics.Snapshot().WritePrometheus(w)
+		})
+		go http.Serve(l, mux)
+	}
+	if *control == "" {
+		// /proc/mounts, where the CLI looks the mount up, has
+		// symlinks resolved.
+		dir := absMnt
+		if d, err := filepath.EvalSymlinks(absMnt); err == nil {
+			dir = d
+		}
+		*control, err = defaultControlSocket(dir, true)
+		if err != nil {
+			fatalf("control socket: %v", err)
+		}
+	}
+	l, err := fs.ListenControl(*control)
+	if err != nil {
+		fatalf("ListenControl: %v", err)
+	}
+	go ctl.Serve(l)
+	cleanup = func() error {
+		l.Close()
+		return os.RemoveAll(tempDir)
+	}
+
+	server, err := fuse.NewServer(conn.RawFS(), mntDir, &fuse.MountOptions{
+		Name:   fsType,
+		FsName: source,
+	})
+	if err != nil {
+		fatalf("MountFileSystem: %v", err)
+	}
+	if *debug {
+		server.SetDebug(true)
+	}
+	fatalf = func(format string, args ...interface{}) {
+		server.Unmount()
+		cleanup()
+		log.Fatalf(format, args...)
+	}
+	if *pidfile != "" {
+		if err := writePidfile(*pidfile); err != nil {
+			fatalf("writing pidfile: %v", err)
+		}
+		prev := cleanup
+		cleanup = func() error {
+			os.Remove(*pidfile)
+			return prev()
+		}
+	}
+	logger = logger.With("mount", mntDir)
+	stopped := make(chan syscall.Signal, 1)
+	go handleSignals(logger, server, mntDir, cleanup, stopped)
+	go handleReload(logger, reload)
+
+	// Serve returns once the filesystem is unmounted, on a signal
+	// or by an outside "gitfs unmount".
+	served := make(chan struct{})
+	go func() {
+		server.Serve()
+		close(served)
+	}()
+	if err := server.WaitMount(); err != nil {
+		fatalf("WaitMount: %v", err)
+	}
+	logger.Infof("started gitfs on %s", mntDir)
+	notifyReady(*readyFd)
+	if *daemon {
+		detachStderr(*logFile)
+	}
+
+	<-served
+	if err := cleanup(); err != nil {
+		log.Fatalf("cleanup: %v", err)
+	}
+	logger.Infof("unmounted")
+	select {
+	case sig := <-stopped:
+		// Like a shell reports a process killed by sig.
+		os.Exit(128 + int(sig))
+	default:
+	}
+}
+
+// handleSignals unmounts the filesystem on SIGINT or SIGTERM, so
+// Serve returns, and sends the signal on stopped. If the filesystem
+// is busy, it is unmounted lazily, and Serve returns when it is no
+// longer in use. On a second signal, or if unmounting fails, it
+// calls cleanup, which removes the temporary directory, the control
+// socket and the pidfile, and exits with status 1. gitfs keeps no
+// other state that would need flushing.
+func handleSignals(logger *fs.Logger, server *fuse.Server, mnt string, cleanup func() error, stopped chan<- syscall.Signal) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigs
+	logger.Infof("got %v, unmounting", sig)
+	stopped <- sig.(syscall.Signal)
+	sdNotify("STOPPING=1")
+	go func() {
+		sig := <-sigs
+		logger.Errorf("got %v again, exiting without unmounting", sig)
+		cleanup()
+		os.Exit(1)
+	}()
+
+	err := server.Unmount()
+	if err == nil {
+		return
+	}
+	logger.Warningf("unmounting: %v; retrying lazily", err)
+	if err := unmount(mnt, true); err != nil {
+		logger.Errorf("lazy unmount: %v", err)
+		cleanup()
+		os.Exit(1)
+	}
+}
+
+// handleReload calls reload on SIGHUP.
+func handleReload(logger *fs.Logger, reload func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if reload == nil {
+			logger.Warningf("got SIGHUP, but there is nothing to reload")
+			continue
+		}
+		logger.Infof("got SIGHUP, reloading")
+		if err := reload(); err != nil {
+			logger.Errorf("reload: %v", err)
+		}
+	}
+}
+
+// countMounts adds the number of mounts of root to the metrics.
+func countMounts(m *fs.Metrics, root interface {
+	Mounts() []fs.MountStatus
+}) {
+	m.AddGauge("mounts", func() int64 {
+		return int64(len(root.Mounts()))
+	})
+}
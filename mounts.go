@@ -0,0 +1,275 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/hanwen/gitfs/fs"
+)
+
+// gitfsMount is a gitfs filesystem listed in /proc/mounts.
+type gitfsMount struct {
+	Source string
+	Dir    string
+}
+
+// unescapeMount undoes the octal escaping of /proc/mounts fields.
+func unescapeMount(s string) string {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
+
+// gitfsMounts lists the mounted gitfs filesystems.
+func gitfsMounts() ([]gitfsMount, error) {
+	content, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	var mounts []gitfsMount
+	for _, l := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) < 3 || fields[2] != "fuse."+fsType {
+			continue
+		}
+		mounts = append(mounts, gitfsMount{
+			Source: unescapeMount(fields[0]),
+			Dir:    unescapeMount(fields[1]),
+		})
+	}
+	return mounts, nil
+}
+
+// findMount returns the gitfs mount containing name, and the path of
+// name relative to it.
+func findMount(name string) (*gitfsMount, string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, "", err
+	}
+	mounts, err := gitfsMounts()
+	if err != nil {
+		return nil, "", err
+	}
+	var best *gitfsMount
+	rel := ""
+	for i, m := range mounts {
+		r, err := filepath.Rel(m.Dir, abs)
+		if err != nil || r == ".." || strings.HasPrefix(r, "../") {
+			continue
+		}
+		if best == nil || len(m.Dir) > len(best.Dir) {
+			best = &mounts[i]
+			rel = r
+		}
+	}
+	if best == nil {
+		return nil, "", fmt.Errorf("%s is not in a gitfs mount", name)
+	}
+	return best, rel, nil
+}
+
+// unmountCmd implements "gitfs unmount MOUNT".
+func unmountCmd(args []string) {
+	flags := flag.NewFlagSet("unmount", flag.ExitOnError)
+	lazy := flags.Bool("lazy", false, "detach the filesystem now, and clean up when it is no longer busy.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("usage: %s unmount [-lazy] MOUNT", os.Args[0])
+	}
+	if err := unmount(flags.Arg(0), *lazy); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// unmount unmounts a FUSE filesystem. A lazy unmount detaches it
+// right away, and cleans up once it is no longer busy.
+func unmount(mnt string, lazy bool) error {
+	if bin, err := exec.LookPath("fusermount"); err == nil {
+		args := []string{"-u"}
+		if lazy {
+			args = append(args, "-z")
+		}
+		cmd := exec.Command(bin, append(args, mnt)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("fusermount: %v", err)
+		}
+		return nil
+	}
+
+	mntFlags := 0
+	if lazy {
+		mntFlags = syscall.MNT_DETACH
+	}
+	if err := syscall.Unmount(mnt, mntFlags); err != nil {
+		return &os.PathError{Op: "unmount", Path: mnt, Err: err}
+	}
+	return nil
+}
+
+// statusCmd implements "gitfs status MOUNT".
+func statusCmd(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("usage: %s status MOUNT", os.Args[0])
+	}
+	mnt := args[0]
+
+	var content []byte
+	var err error
+	for _, name := range []string{
+		filepath.Join(mnt, "config", fs.ConfigStatusFile),
+		filepath.Join(mnt, fs.StatusFile),
+	} {
+		content, err = ioutil.ReadFile(name)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		// Single tree mounts have no status file.
+		m, rel, ferr := findMount(mnt)
+		if ferr != nil || rel != "." {
+			log.Fatalf("%s does not look like a gitfs mount: %v", mnt, err)
+		}
+		content = []byte(fmt.Sprintf(".\t%s\t%s\n", m.Source, treeCommit(mnt)))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "PATH\tSOURCE\tCOMMIT\n")
+	w.Write(content)
+	w.Flush()
+}
+
+// treeCommit returns the commit mounted at the root of a single tree
+// mount, or "-" if it is not known.
+func treeCommit(mnt string) string {
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(mnt, fs.CommitXAttr, buf)
+	if err != nil {
+		return "-"
+	}
+	return string(buf[:n])
+}
+
+// lsMountsCmd implements "gitfs ls-mounts".
+func lsMountsCmd(args []string) {
+	if len(args) != 0 {
+		log.Fatalf("usage: %s ls-mounts", os.Args[0])
+	}
+	mounts, err := gitfsMounts()
+	if err != nil {
+		log.Fatalf("gitfsMounts: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, m := range mounts {
+		fmt.Fprintf(w, "%s\t%s\n", m.Dir, m.Source)
+	}
+	w.Flush()
+}
+
+// addCmd implements "gitfs add [-control SOCKET | -symlink]
+// REPO-DIR:TREEISH PATH", by calling AddMount on the control socket of
+// the enclosing multi-repo mount, or with -symlink, by creating the
+// symlink in its config directory.
+func addCmd(args []string) {
+	flags := flag.NewFlagSet("add", flag.ExitOnError)
+	control := flags.String("control", "", "the control socket of the mount, if it was mounted with -control.")
+	symlink := flags.Bool("symlink", false, "create the symlink in the config directory instead of using the control socket.")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 2 || (*symlink && *control != "") {
+		log.Fatalf("usage: %s add [-control SOCKET | -symlink] REPO-DIR:TREEISH|DIR PATH", os.Args[0])
+	}
+	source := args[0]
+	components := strings.Split(source, ":")
+	if len(components) > 2 {
+		log.Fatalf("source must have format REPO-DIR:TREEISH or DIR")
+	}
+	dir, err := filepath.Abs(components[0])
+	if err != nil {
+		log.Fatalf("Abs: %v", err)
+	}
+	components[0] = dir
+	source = strings.Join(components, ":")
+
+	mnt, rel, err := findMount(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if rel == "." || rel == "config" || strings.HasPrefix(rel, "config/") {
+		log.Fatalf("cannot mount over %s", args[1])
+	}
+	if *symlink {
+		config := filepath.Join(mnt.Dir, "config")
+		if err := os.MkdirAll(filepath.Join(config, filepath.Dir(rel)), 0755); err != nil {
+			log.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.Symlink(source, filepath.Join(config, rel)); err != nil {
+			log.Fatalf("Symlink: %v", err)
+		}
+		return
+	}
+
+	socket := *control
+	if socket == "" {
+		if socket, err = defaultControlSocket(mnt.Dir, false); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := fs.CallControl(socket, &fs.ControlRequest{Method: "AddMount", Path: rel, Source: source}); err != nil {
+		log.Fatalf("AddMount: %v", err)
+	}
+}
+
+// removeCmd implements "gitfs remove [-control SOCKET | -symlink]
+// PATH", like addCmd.
+func removeCmd(args []string) {
+	flags := flag.NewFlagSet("remove", flag.ExitOnError)
+	control := flags.String("control", "", "the control socket of the mount, if it was mounted with -control.")
+	symlink := flags.Bool("symlink", false, "remove the symlink from the config directory instead of using the control socket.")
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) != 1 || (*symlink && *control != "") {
+		log.Fatalf("usage: %s remove [-control SOCKET | -symlink] PATH", os.Args[0])
+	}
+	mnt, rel, err := findMount(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *symlink {
+		if err := os.Remove(filepath.Join(mnt.Dir, "config", rel)); err != nil {
+			log.Fatalf("Remove: %v", err)
+		}
+		return
+	}
+
+	socket := *control
+	if socket == "" {
+		if socket, err = defaultControlSocket(mnt.Dir, false); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := fs.CallControl(socket, &fs.ControlRequest{Method: "RemoveMount", Path: rel}); err != nil {
+		log.Fatalf("RemoveMount: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/gitfs/fs"
+)
+
+// readAllowFile reads the paths of an allowlist, one per line.
+// Empty lines and lines starting with '#' are ignored.
+func readAllowFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		paths = append(paths, l)
+	}
+	return paths, scanner.Err()
+}
+
+// restrictCmd implements "gitfs restrict SOCKET ALLOW-FILE CMD
+// [ARGS]". It runs CMD so that it, and its children, only see the
+// paths in ALLOW-FILE in a "mount -hermetic" filesystem, and exits
+// with the status of CMD.
+func restrictCmd(args []string) {
+	flags := flag.NewFlagSet("restrict", flag.ExitOnError)
+	repo := flags.String("repo", "", "only restrict trees of the repository in this directory.")
+	flags.Parse(args)
+	if flags.NArg() < 3 {
+		log.Fatalf("usage: %s restrict [-repo DIR] SOCKET ALLOW-FILE CMD [ARGS]", os.Args[0])
+	}
+	socket := flags.Arg(0)
+	paths, err := readAllowFile(flags.Arg(1))
+	if err != nil {
+		log.Fatalf("reading allowlist: %v", err)
+	}
+
+	// The rule covers this process, so it is in place before CMD
+	// starts.
+	rule := fs.AllowRule{
+		Pid:   uint32(os.Getpid()),
+		Paths: paths,
+	}
+	if *repo != "" {
+		if rule.Repo, err = filepath.Abs(*repo); err != nil {
+			log.Fatalf("Abs: %v", err)
+		}
+	}
+	if _, err := fs.CallControl(socket, &fs.ControlRequest{Method: "AllowAdd", Rule: &rule}); err != nil {
+		log.Fatalf("AllowAdd: %v", err)
+	}
+
+	cmd := exec.Command(flags.Arg(2), flags.Args()[3:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+
+	if _, err := fs.CallControl(socket, &fs.ControlRequest{Method: "AllowRemove", Pid: rule.Pid}); err != nil {
+		log.Printf("AllowRemove: %v", err)
+	}
+	if exit, ok := runErr.(*exec.ExitError); ok {
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			os.Exit(status.ExitStatus())
+		}
+		os.Exit(1)
+	} else if runErr != nil {
+		log.Fatalf("%s: %v", flags.Arg(2), runErr)
+	}
+}